@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/taskie/polkadot/pkg/polkadot"
+)
+
+// Commands
+
+type command struct {
+	Name        string
+	Args        string
+	Description string
+	Run         func(args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{"build", "[flags] <component-dir>...", "generates the dotfiles", runBuild},
+		{"plan", "[flags] <component-dir>...", "shows what build would do without writing anything", runPlan},
+		{"tags", "<component-dir>...", "prints the resolved tags, where each value came from and what it overrides", runTags},
+		{"sources", "<target> <component-dir>...", "prints the sources woven into a target", runSources},
+		{"explain", "<fragment> <component-dir>...", "tells why a fragment is included in or excluded from each target", runExplain},
+		{"report", "[flags] <component-dir>...", "lists the fragments excluded from each target and why", runReport},
+		{"lint", "<component-dir>...", "lists the tags used by templates but defined nowhere", runLint},
+		{"rollback", "[-root <dir> | -home <dir>] [<run-id>]", "restores the files changed by the last (or the given) run", runRollback},
+		{"version", "", "shows version info", runVersion},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func newFlagSet(cmd *command) *flag.FlagSet {
+	flagSet := flag.NewFlagSet("polkadot "+cmd.Name, flag.ExitOnError)
+	flagSet.Usage = func() {
+		w := flagSet.Output()
+		fmt.Fprintf(w, "Usage: polkadot %s %s\n\n%s\n", cmd.Name, cmd.Args, cmd.Description)
+		hasFlags := false
+		flagSet.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(w, "\nFlags:")
+			flagSet.PrintDefaults()
+		}
+	}
+	return flagSet
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage:\n  polkadot <command> [arguments]\n  polkadot [flags] <component-dir>...\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.Name, cmd.Description)
+	}
+	fmt.Fprintf(w, "\nFlags (without a command):\n")
+	flag.PrintDefaults()
+}
+
+type buildOptions struct {
+	dryRun    bool
+	diff      bool
+	prune     bool
+	rawConcat bool
+	strict    bool
+	force     bool
+	keepEdits bool
+	format    string
+	root      string
+	home      string
+}
+
+// buildDocument is printed by build and plan with -format json.
+type buildDocument struct {
+	DryRun  bool                    `json:"dry_run"`
+	Plan    *polkadot.Plan          `json:"plan"`
+	Results []polkadot.TargetResult `json:"results"`
+	Pruned  []string                `json:"pruned"`
+	Error   string                  `json:"error,omitempty"`
+}
+
+func addFormatFlag(flagSet *flag.FlagSet, p *string) {
+	flagSet.StringVar(p, "format", "text", "output format: text or json (a document on stdout, progress on stderr)")
+}
+
+func addRootFlag(flagSet *flag.FlagSet, p *string) {
+	flagSet.StringVar(p, "root", "", "writes the files under this directory instead of / (the manifest and backups go to its .polkadot)")
+}
+
+func addHomeFlag(flagSet *flag.FlagSet, p *string) {
+	flagSet.StringVar(p, "home", "", "expands ~/ in output paths to this directory instead of $HOME (the manifest and backups go to its .polkadot)")
+}
+
+// addBuildFlags declares the flags of build, plan and the legacy invocation.
+// With dryRun, the flags for overwriting edited files are left out.
+func addBuildFlags(flagSet *flag.FlagSet, dryRun bool) *buildOptions {
+	opts := &buildOptions{dryRun: dryRun}
+	flagSet.BoolVar(&opts.rawConcat, "raw", false, "concatenate files without normalizing newlines")
+	flagSet.BoolVar(&opts.strict, "strict", false, "fails on tags missing from templates instead of rendering them empty")
+	flagSet.BoolVar(&opts.diff, "d", false, "shows a unified diff of the changes to be made")
+	if dryRun {
+		flagSet.BoolVar(&opts.prune, "prune", false, "lists previously generated files that are no longer produced")
+	} else {
+		flagSet.BoolVar(&opts.prune, "prune", false, "removes previously generated files that are no longer produced")
+		flagSet.BoolVar(&opts.force, "force", false, "overwrites files edited since they were last generated")
+		flagSet.BoolVar(&opts.keepEdits, "keep-edits", false, "saves files edited since they were last generated aside before overwriting them")
+	}
+	addFormatFlag(flagSet, &opts.format)
+	addRootFlag(flagSet, &opts.root)
+	addHomeFlag(flagSet, &opts.home)
+	return opts
+}
+
+// newApp creates an App for the dotfiles root in the working directory and
+// the component directories on the disk.
+func newApp(polkaDirPaths []string, opts polkadot.Options) (*polkadot.App, error) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	opts.DotfilesDir = pwd
+	for _, dirPath := range polkaDirPaths {
+		opts.Components = append(opts.Components, polkadot.DirComponent(dirPath))
+	}
+	if opts.Out == nil {
+		opts.Out = os.Stdout
+	}
+	opts.Logger = log.Default()
+	return polkadot.New(opts), nil
+}
+
+// prepareApp loads and resolves everything up to weaving, for the commands
+// which only inspect the result.
+func prepareApp(polkaDirPaths []string) (*polkadot.App, error) {
+	app, err := newApp(polkaDirPaths, polkadot.Options{})
+	if err != nil {
+		return nil, err
+	}
+	color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Preparing...")
+	if err := app.Prepare(); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func build(opts buildOptions, polkaDirPaths []string) error {
+	if opts.format != "text" && opts.format != "json" {
+		return fmt.Errorf("unknown format: %s", opts.format)
+	}
+	var out io.Writer = os.Stdout
+	if opts.format == "json" {
+		statusOut = os.Stderr
+		out = os.Stderr
+	}
+	app, err := newApp(polkaDirPaths, polkadot.Options{
+		RawConcat: opts.rawConcat,
+		Strict:    opts.strict,
+		Force:     opts.force,
+		KeepEdits: opts.keepEdits,
+		Home:      opts.home,
+		DestDir:   opts.root,
+		Out:       out,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = buildApp(app, opts, out)
+	if opts.format == "json" {
+		doc := buildDocument{
+			DryRun:  opts.dryRun,
+			Results: app.Results(),
+			Pruned:  app.Pruned(),
+		}
+		if app.Entries() != nil {
+			plan, planErr := app.Plan()
+			if planErr != nil {
+				return errors.Join(err, planErr)
+			}
+			doc.Plan = &plan
+		}
+		if err != nil {
+			doc.Error = err.Error()
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(doc); encodeErr != nil {
+			return errors.Join(err, encodeErr)
+		}
+	}
+	return err
+}
+
+func buildApp(app *polkadot.App, opts buildOptions, out io.Writer) error {
+	color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Preparing...")
+	err := app.Prepare()
+	if err != nil {
+		return err
+	}
+	app.PrintEntries()
+	if opts.diff {
+		color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Comparing...")
+		err = app.Diff(out)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.dryRun {
+		color.New(color.FgYellow, color.Bold).Fprintln(statusOut, "* Dry-run mode is enabled.")
+	} else {
+		color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Executing...")
+		err = app.Execute()
+		if err != nil {
+			return err
+		}
+	}
+	if opts.prune {
+		color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Pruning...")
+		err = app.Prune(opts.dryRun)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rollback(stateDirPath string, runID string) error {
+	color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Rolling back...")
+	run, err := polkadot.LoadStateBackupRun(stateDirPath, runID)
+	if err != nil {
+		return err
+	}
+	log.Printf("run: %s (started at %s)\n", run.ID, run.StartedAt.Format(time.RFC3339))
+	for _, file := range run.Files {
+		if file.Link != "" {
+			fmt.Printf("restore %s (link to %s)\n", file.Path, file.Link)
+		} else if file.Existed {
+			fmt.Printf("restore %s (mode: %s)\n", file.Path, file.Mode)
+		} else {
+			fmt.Printf("remove %s\n", file.Path)
+		}
+	}
+	return run.Rollback()
+}
+
+// runLegacy handles invocations without a command, as in earlier versions.
+func runLegacy(args []string) error {
+	opts := addBuildFlags(flag.CommandLine, false)
+	flag.BoolVar(&opts.dryRun, "n", false, "performs a trial run")
+	rollbackFlag := flag.Bool("rollback", false, "restores the files changed by the last run (or the run given as argument)")
+	versionFlag := flag.Bool("V", false, "shows version info")
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	if *versionFlag {
+		return runVersion(nil)
+	}
+	if *rollbackFlag {
+		if opts.root != "" {
+			return runRollback(append([]string{"-root", opts.root}, flag.Args()...))
+		}
+		if opts.home != "" {
+			return runRollback(append([]string{"-home", opts.home}, flag.Args()...))
+		}
+		return runRollback(flag.Args())
+	}
+	return build(*opts, flag.Args())
+}
+
+func runBuild(args []string) error {
+	flagSet := newFlagSet(findCommand("build"))
+	opts := addBuildFlags(flagSet, false)
+	flagSet.Parse(args)
+	return build(*opts, flagSet.Args())
+}
+
+func runPlan(args []string) error {
+	flagSet := newFlagSet(findCommand("plan"))
+	opts := addBuildFlags(flagSet, true)
+	flagSet.Parse(args)
+	return build(*opts, flagSet.Args())
+}
+
+func runTags(args []string) error {
+	flagSet := newFlagSet(findCommand("tags"))
+	flagSet.Parse(args)
+	app, err := prepareApp(flagSet.Args())
+	if err != nil {
+		return err
+	}
+	var tags []string
+	provenance := app.TagProvenance()
+	for tag := range provenance {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+	for _, tag := range tags {
+		records := provenance[tag]
+		c := color.New(color.FgBlue)
+		if records[0].Negative {
+			c = color.New(color.FgRed)
+		}
+		c.Printf("%s", tag)
+		fmt.Printf(": %s\n", records[0].String())
+		for _, record := range records[1:] {
+			color.New(color.Faint).Printf("  overrides %s\n", record.String())
+		}
+	}
+	return nil
+}
+
+func runSources(args []string) error {
+	flagSet := newFlagSet(findCommand("sources"))
+	flagSet.Parse(args)
+	if flagSet.NArg() < 1 {
+		flagSet.Usage()
+		return fmt.Errorf("missing target")
+	}
+	target := flagSet.Arg(0)
+	app, err := prepareApp(flagSet.Args()[1:])
+	if err != nil {
+		return err
+	}
+	entry, ok := app.FindEntry(target)
+	if !ok {
+		return fmt.Errorf("no rule generates %s", target)
+	}
+	for _, source := range entry.Sources {
+		if source.IsTemplate() {
+			fmt.Printf("%s (template)\n", source.Path)
+		} else {
+			fmt.Println(source.Path)
+		}
+	}
+	return nil
+}
+
+func printReason(explanation polkadot.Explanation) {
+	c := color.New(color.FgRed)
+	if explanation.Included() {
+		c = color.New(color.FgGreen)
+	}
+	c.Printf("  %s\n", explanation.Reason())
+}
+
+func runExplain(args []string) error {
+	flagSet := newFlagSet(findCommand("explain"))
+	flagSet.Parse(args)
+	if flagSet.NArg() < 1 {
+		flagSet.Usage()
+		return fmt.Errorf("missing fragment")
+	}
+	fragment := flagSet.Arg(0)
+	app, err := prepareApp(flagSet.Args()[1:])
+	if err != nil {
+		return err
+	}
+	explanations := app.Explain(fragment)
+	if len(explanations) == 0 {
+		return fmt.Errorf("%s is not in the directory of any rule", fragment)
+	}
+	for _, explanation := range explanations {
+		color.New(color.FgBlue).Printf("%s", explanation.Target)
+		fmt.Printf(": %s\n", explanation.Source.Path)
+		printReason(explanation)
+	}
+	return nil
+}
+
+func runReport(args []string) error {
+	flagSet := newFlagSet(findCommand("report"))
+	allFlag := flagSet.Bool("all", false, "also lists the included files")
+	patternFlag := flagSet.Bool("pattern", false, "also lists the files which do not match the pattern of a rule")
+	flagSet.Parse(args)
+	app, err := prepareApp(flagSet.Args())
+	if err != nil {
+		return err
+	}
+	target := ""
+	for _, explanation := range app.Explanations() {
+		if explanation.Included() && !*allFlag {
+			continue
+		}
+		if !explanation.PatternMatched && !*patternFlag {
+			continue
+		}
+		if explanation.Target != target {
+			target = explanation.Target
+			color.New(color.FgBlue).Println(target)
+		}
+		fmt.Printf("- %s\n", explanation.Source.Path)
+		printReason(explanation)
+	}
+	return nil
+}
+
+func runLint(args []string) error {
+	flagSet := newFlagSet(findCommand("lint"))
+	flagSet.Parse(args)
+	app, err := newApp(flagSet.Args(), polkadot.Options{})
+	if err != nil {
+		return err
+	}
+	color.New(color.FgCyan, color.Bold).Fprintln(statusOut, "* Linting...")
+	issues, err := app.Lint()
+	if err != nil {
+		return err
+	}
+	errorCount := 0
+	for _, issue := range issues {
+		if issue.Warning {
+			color.New(color.FgYellow).Println(issue)
+			continue
+		}
+		color.New(color.FgRed).Println(issue)
+		errorCount++
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("lint found %d error(s)", errorCount)
+	}
+	return nil
+}
+
+func runRollback(args []string) error {
+	flagSet := newFlagSet(findCommand("rollback"))
+	rootFlag := flagSet.String("root", "", "rolls back a run of build -root into this directory")
+	homeFlag := flagSet.String("home", "", "rolls back a run of build -home with this directory")
+	flagSet.Parse(args)
+	if flagSet.NArg() > 1 {
+		return fmt.Errorf("too many arguments: %v", flagSet.Args())
+	}
+	if *rootFlag != "" {
+		return rollback(filepath.Join(*rootFlag, polkadot.StateDirName), flagSet.Arg(0))
+	}
+	if *homeFlag != "" {
+		return rollback(filepath.Join(*homeFlag, polkadot.StateDirName), flagSet.Arg(0))
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	return rollback(filepath.Join(pwd, polkadot.StateDirName), flagSet.Arg(0))
+}
+
+func runVersion(args []string) error {
+	fmt.Println(version)
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/fatih/color"
+)
+
+const version = "0.1.0"
+
+// statusOut receives the progress headers. Commands printing a document to
+// stdout move it to stderr.
+var statusOut io.Writer = os.Stdout
+
+func main() {
+	err := run()
+	if err != nil {
+		color.New(color.FgRed, color.Bold).Fprintln(statusOut, "* Failed.")
+		log.Fatal(err)
+	}
+	color.New(color.FgGreen, color.Bold).Fprintln(statusOut, "* Completed.")
+}
+
+func run() error {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if cmd := findCommand(args[0]); cmd != nil {
+			// an existing component directory keeps its legacy meaning
+			if info, err := os.Stat(args[0]); err == nil && info.IsDir() {
+				log.Printf("warning: %s is taken for a component directory, not the %s command (rename the directory to use it)", args[0], cmd.Name)
+				return runLegacy(args)
+			}
+			return cmd.Run(args[1:])
+		}
+	}
+	return runLegacy(args)
+}
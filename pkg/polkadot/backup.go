@@ -0,0 +1,251 @@
+package polkadot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Backup
+
+const (
+	backupsDirName = "backups"
+	editedDirName  = "edited"
+	runFileName    = "run.json"
+)
+
+// BackupRun keeps the previous state of every target touched by one run, so
+// that the run can be rolled back. Its directory is created on the first Save.
+type BackupRun struct {
+	ID         string       `json:"id"`
+	StartedAt  time.Time    `json:"started_at"`
+	RolledBack bool         `json:"rolled_back,omitempty"`
+	Files      []BackupFile `json:"files"`
+
+	backupsDirPath string
+	manifestPath   string
+	targets        TargetFS // the disk if nil
+}
+
+// BackupFile is the state of one target before the run touched it.
+type BackupFile struct {
+	Path    string `json:"path"`
+	Existed bool   `json:"existed"`
+	Mode    string `json:"mode,omitempty"`   // octal, like rules.yml
+	Backup  string `json:"backup,omitempty"` // file name in the run directory
+	Link    string `json:"link,omitempty"`   // what it pointed to, if a link
+}
+
+// NewBackupRun returns a run whose directory is created under backupsDirPath
+// by the first Save. manifestPath is snapshotted at the same time.
+func NewBackupRun(backupsDirPath string, manifestPath string) *BackupRun {
+	return &BackupRun{
+		StartedAt:      time.Now(),
+		backupsDirPath: backupsDirPath,
+		manifestPath:   manifestPath,
+	}
+}
+
+func (r *BackupRun) dirPath() string {
+	return filepath.Join(r.backupsDirPath, r.ID)
+}
+
+// init creates the run directory and snapshots the manifest.
+func (r *BackupRun) init() error {
+	if r.ID != "" {
+		return nil
+	}
+	if err := os.MkdirAll(r.backupsDirPath, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", r.backupsDirPath, err)
+	}
+	baseID := r.StartedAt.Format("20060102-150405")
+	for i := 1; ; i++ {
+		id := baseID
+		if i > 1 {
+			id = baseID + "-" + strconv.Itoa(i)
+		}
+		err := os.Mkdir(filepath.Join(r.backupsDirPath, id), 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("mkdir %s: %w", id, err)
+		}
+		r.ID = id
+		break
+	}
+	if err := copyFile(r.manifestPath, filepath.Join(r.dirPath(), manifestFileName), 0644); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (r *BackupRun) write() error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", runFileName, err)
+	}
+	runPath := filepath.Join(r.dirPath(), runFileName)
+	if err := os.WriteFile(runPath, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", runPath, err)
+	}
+	return nil
+}
+
+// Save records the state of path before it is overwritten. Only the first
+// call for each path is recorded.
+func (r *BackupRun) Save(path string) error {
+	for _, file := range r.Files {
+		if file.Path == path {
+			return nil
+		}
+	}
+	if err := r.init(); err != nil {
+		return err
+	}
+	targets := targetFSOrDisk(r.targets)
+	file := BackupFile{Path: path}
+	info, err := targets.Lstat(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("stat %s: %w", path, err)
+	}
+	if info != nil && info.Mode()&fs.ModeSymlink != 0 {
+		file.Existed = true
+		file.Link, err = targets.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("readlink %s: %w", path, err)
+		}
+	} else if info != nil {
+		file.Existed = true
+		file.Mode = fmt.Sprintf("%04o", info.Mode().Perm())
+		file.Backup = fmt.Sprintf("%03d-%s", len(r.Files), filepath.Base(path))
+		content, err := targets.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		backupPath := filepath.Join(r.dirPath(), file.Backup)
+		if err := os.WriteFile(backupPath, content, 0600); err != nil {
+			return fmt.Errorf("write %s: %w", backupPath, err)
+		}
+	}
+	r.Files = append(r.Files, file)
+	return r.write()
+}
+
+// LoadStateBackupRun is LoadBackupRun for the backups and the manifest kept
+// in stateDirPath, see Options.StateDir.
+func LoadStateBackupRun(stateDirPath string, id string) (*BackupRun, error) {
+	return LoadBackupRun(filepath.Join(stateDirPath, backupsDirName), filepath.Join(stateDirPath, manifestFileName), id)
+}
+
+// LoadBackupRun reads the run named id, or the latest run which has not been
+// rolled back if id is empty.
+func LoadBackupRun(backupsDirPath string, manifestPath string, id string) (*BackupRun, error) {
+	if id == "" {
+		return loadLatestBackupRun(backupsDirPath, manifestPath)
+	}
+	runPath := filepath.Join(backupsDirPath, id, runFileName)
+	buf, err := os.ReadFile(runPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", runPath, err)
+	}
+	var run BackupRun
+	if err := json.Unmarshal(buf, &run); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", runPath, err)
+	}
+	run.backupsDirPath = backupsDirPath
+	run.manifestPath = manifestPath
+	return &run, nil
+}
+
+func loadLatestBackupRun(backupsDirPath string, manifestPath string) (*BackupRun, error) {
+	dirEntries, err := os.ReadDir(backupsDirPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s: %w", backupsDirPath, err)
+	}
+	var latest *BackupRun
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+		run, err := LoadBackupRun(backupsDirPath, manifestPath, dirEntry.Name())
+		if err != nil {
+			return nil, err
+		}
+		if run.RolledBack {
+			continue
+		}
+		if latest == nil || run.StartedAt.After(latest.StartedAt) {
+			latest = run
+		}
+	}
+	if latest == nil {
+		return nil, errors.New("no run to roll back")
+	}
+	return latest, nil
+}
+
+// Rollback restores every file touched by the run, removes the files it
+// created and restores the manifest as it was before the run.
+func (r *BackupRun) Rollback() error {
+	if r.RolledBack {
+		return fmt.Errorf("run %s is already rolled back", r.ID)
+	}
+	targets := targetFSOrDisk(r.targets)
+	for i := len(r.Files) - 1; i >= 0; i-- {
+		file := r.Files[i]
+		if !file.Existed {
+			if err := targets.Remove(file.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("remove %s: %w", file.Path, err)
+			}
+			continue
+		}
+		if file.Link != "" {
+			if err := targets.Symlink(file.Link, file.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		mode, err := strconv.ParseUint(file.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("%s: invalid mode %q: %w", file.Path, file.Mode, err)
+		}
+		content, err := os.ReadFile(filepath.Join(r.dirPath(), file.Backup))
+		if err != nil {
+			return fmt.Errorf("read backup of %s: %w", file.Path, err)
+		}
+		if err := targets.WriteFile(file.Path, content, os.FileMode(mode)); err != nil {
+			return fmt.Errorf("write %s: %w", file.Path, err)
+		}
+	}
+
+	err := copyFile(filepath.Join(r.dirPath(), manifestFileName), r.manifestPath, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = os.Remove(r.manifestPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("restore manifest: %w", err)
+	}
+
+	r.RolledBack = true
+	return r.write()
+}
+
+func copyFile(srcPath string, dstPath string, perm os.FileMode) error {
+	content, err := os.ReadFile(srcPath)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", srcPath, err)
+	}
+	if err := os.WriteFile(dstPath, content, perm); err != nil {
+		return fmt.Errorf("write %s: %w", dstPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package polkadot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupRun(t *testing.T) {
+	setup := func(t *testing.T) (string, string, string) {
+		dir := t.TempDir()
+		stateDir := filepath.Join(dir, ".polkadot")
+		os.MkdirAll(stateDir, 0755)
+		return dir, filepath.Join(stateDir, backupsDirName), filepath.Join(stateDir, manifestFileName)
+	}
+
+	t.Run("rollback/restores_and_removes", func(t *testing.T) {
+		dir, backupsDir, manifestPath := setup(t)
+		existing := filepath.Join(dir, "existing")
+		created := filepath.Join(dir, "created")
+		os.WriteFile(existing, []byte("before\n"), 0600)
+		os.WriteFile(manifestPath, []byte("{}\n"), 0644)
+
+		run := NewBackupRun(backupsDir, manifestPath)
+		if err := run.Save(existing); err != nil {
+			t.Fatal(err)
+		}
+		if err := run.Save(created); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(existing, []byte("after\n"), 0644)
+		os.Chmod(existing, 0644)
+		os.WriteFile(created, []byte("new\n"), 0644)
+		os.WriteFile(manifestPath, []byte(`{"targets": []}`), 0644)
+
+		loaded, err := LoadBackupRun(backupsDir, manifestPath, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.ID != run.ID {
+			t.Fatalf("got run %q, want %q", loaded.ID, run.ID)
+		}
+		if err := loaded.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(existing)
+		if string(content) != "before\n" {
+			t.Errorf("got %q, want %q", string(content), "before\n")
+		}
+		if info, _ := os.Stat(existing); info.Mode().Perm() != 0600 {
+			t.Errorf("got mode %o, want %o", info.Mode().Perm(), 0600)
+		}
+		if _, err := os.Stat(created); !os.IsNotExist(err) {
+			t.Error("expected created file to be removed")
+		}
+		manifest, _ := os.ReadFile(manifestPath)
+		if string(manifest) != "{}\n" {
+			t.Errorf("expected manifest to be restored, got %q", string(manifest))
+		}
+	})
+
+	t.Run("save/records_first_state_only", func(t *testing.T) {
+		dir, backupsDir, manifestPath := setup(t)
+		p := filepath.Join(dir, "file")
+		os.WriteFile(p, []byte("first\n"), 0644)
+
+		run := NewBackupRun(backupsDir, manifestPath)
+		run.Save(p)
+		os.WriteFile(p, []byte("second\n"), 0644)
+		run.Save(p)
+		if len(run.Files) != 1 {
+			t.Fatalf("expected 1 file, got %d", len(run.Files))
+		}
+		content, _ := os.ReadFile(filepath.Join(backupsDir, run.ID, run.Files[0].Backup))
+		if string(content) != "first\n" {
+			t.Errorf("got %q, want %q", string(content), "first\n")
+		}
+	})
+
+	t.Run("latest/skips_rolled_back", func(t *testing.T) {
+		dir, backupsDir, manifestPath := setup(t)
+		p := filepath.Join(dir, "file")
+
+		older := NewBackupRun(backupsDir, manifestPath)
+		older.StartedAt = time.Now().Add(-time.Hour)
+		older.Save(p)
+		newer := NewBackupRun(backupsDir, manifestPath)
+		newer.Save(p)
+
+		if err := newer.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadBackupRun(backupsDir, manifestPath, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.ID != older.ID {
+			t.Errorf("got run %q, want %q", loaded.ID, older.ID)
+		}
+		if err := newer.Rollback(); err == nil {
+			t.Error("expected an error when rolling back twice")
+		}
+	})
+
+	t.Run("latest/none", func(t *testing.T) {
+		_, backupsDir, manifestPath := setup(t)
+		if _, err := LoadBackupRun(backupsDir, manifestPath, ""); err == nil {
+			t.Error("expected an error without runs")
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package polkadot
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// Diff
+
+const diffContext = 3
+
+type diffKind byte
+
+const (
+	diffEqual  diffKind = ' '
+	diffDelete diffKind = '-'
+	diffInsert diffKind = '+'
+)
+
+// diffOp is one line of an edit script. A and B are the 0-based positions
+// in the old and new line slices at which the operation applies.
+type diffOp struct {
+	Kind diffKind
+	A    int
+	B    int
+	Line string
+}
+
+type diffHunk struct {
+	Ops []diffOp
+}
+
+// splitLines splits content into lines, keeping the trailing "\n" of each line
+// so that a missing newline at EOF is reported as a change.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script with the linear-space variant of
+// the Myers algorithm, so that the memory grows with the number of lines
+// rather than with its square.
+func diffLines(a, b []string) []diffOp {
+	return appendDiff(make([]diffOp, 0, len(a)+len(b)), a, b, 0, len(a), 0, len(b))
+}
+
+// appendDiff appends the edit script turning a[aLo:aHi] into b[bLo:bHi].
+func appendDiff(ops []diffOp, a, b []string, aLo, aHi, bLo, bHi int) []diffOp {
+	for aLo < aHi && bLo < bHi && a[aLo] == b[bLo] {
+		ops = append(ops, diffOp{Kind: diffEqual, A: aLo, B: bLo, Line: a[aLo]})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi-suffix && bLo < bHi-suffix && a[aHi-suffix-1] == b[bHi-suffix-1] {
+		suffix++
+	}
+	aEnd, bEnd := aHi-suffix, bHi-suffix
+	switch {
+	case aLo == aEnd:
+		for y := bLo; y < bEnd; y++ {
+			ops = append(ops, diffOp{Kind: diffInsert, A: aLo, B: y, Line: b[y]})
+		}
+	case bLo == bEnd:
+		for x := aLo; x < aEnd; x++ {
+			ops = append(ops, diffOp{Kind: diffDelete, A: x, B: bLo, Line: a[x]})
+		}
+	default:
+		x, y, u, v := middleSnake(a, b, aLo, aEnd, bLo, bEnd)
+		ops = appendDiff(ops, a, b, aLo, x, bLo, y)
+		for ; x < u; x, y = x+1, y+1 {
+			ops = append(ops, diffOp{Kind: diffEqual, A: x, B: y, Line: a[x]})
+		}
+		ops = appendDiff(ops, a, b, u, aEnd, v, bEnd)
+	}
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{Kind: diffEqual, A: aEnd + i, B: bEnd + i, Line: a[aEnd+i]})
+	}
+	return ops
+}
+
+// middleSnake returns the snake (x, y) to (u, v) in the middle of a shortest
+// edit script turning a[aLo:aHi] into b[bLo:bHi], searching forward from the
+// start and backward from the end at once. The ranges must differ.
+func middleSnake(a, b []string, aLo, aHi, bLo, bHi int) (x, y, u, v int) {
+	n, m := aHi-aLo, bHi-bLo
+	delta := n - m
+	odd := delta%2 != 0
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	// the furthest x on each diagonal k = x - y, from the start and, on the
+	// reversed sequences, from the end
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[aLo+x] == b[bLo+y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if back := delta - k; odd && back >= -(d-1) && back <= d-1 && x+backward[offset+back] >= n {
+				return aLo + startX, bLo + startY, aLo + x, bLo + y
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			startX, startY := x, y
+			for x < n && y < m && a[aHi-1-x] == b[bHi-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if front := delta - k; !odd && front >= -d && front <= d && x+forward[offset+front] >= n {
+				return aHi - x, bHi - y, aHi - startX, bHi - startY
+			}
+		}
+	}
+	panic("diff: no middle snake")
+}
+
+// makeHunks groups changes that are at most 2*context lines apart.
+func makeHunks(ops []diffOp, context int) []diffHunk {
+	var hunks []diffHunk
+	for i := 0; i < len(ops); {
+		if ops[i].Kind == diffEqual {
+			i++
+			continue
+		}
+		start := max(i-context, 0)
+		last := i
+		for j := i + 1; j < len(ops); j++ {
+			if ops[j].Kind == diffEqual {
+				continue
+			}
+			if j-last-1 > 2*context {
+				break
+			}
+			last = j
+		}
+		end := min(last+context+1, len(ops))
+		hunks = append(hunks, diffHunk{Ops: ops[start:end]})
+		i = end
+	}
+	return hunks
+}
+
+func (h *diffHunk) header() string {
+	oldCount, newCount := 0, 0
+	for _, op := range h.Ops {
+		if op.Kind != diffInsert {
+			oldCount++
+		}
+		if op.Kind != diffDelete {
+			newCount++
+		}
+	}
+	oldStart, newStart := h.Ops[0].A, h.Ops[0].B
+	if oldCount > 0 {
+		oldStart++
+	}
+	if newCount > 0 {
+		newStart++
+	}
+	return fmt.Sprintf("@@ -%s +%s @@", formatHunkRange(oldStart, oldCount), formatHunkRange(newStart, newCount))
+}
+
+func formatHunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// writeUnifiedDiff writes the hunks between oldContent and newContent.
+// It writes nothing when both are identical.
+func writeUnifiedDiff(w io.Writer, oldName, newName string, oldContent, newContent []byte) error {
+	hunks := makeHunks(diffLines(splitLines(oldContent), splitLines(newContent)), diffContext)
+	if len(hunks) == 0 {
+		return nil
+	}
+	if _, err := color.New(color.Bold).Fprintf(w, "--- %s\n+++ %s\n", oldName, newName); err != nil {
+		return err
+	}
+	for _, hunk := range hunks {
+		if _, err := color.New(color.FgCyan).Fprintln(w, hunk.header()); err != nil {
+			return err
+		}
+		for _, op := range hunk.Ops {
+			line := string(op.Kind) + strings.TrimSuffix(op.Line, "\n")
+			var err error
+			switch op.Kind {
+			case diffDelete:
+				_, err = color.New(color.FgRed).Fprintln(w, line)
+			case diffInsert:
+				_, err = color.New(color.FgGreen).Fprintln(w, line)
+			default:
+				_, err = fmt.Fprintln(w, line)
+			}
+			if err != nil {
+				return err
+			}
+			if !strings.HasSuffix(op.Line, "\n") {
+				if _, err := fmt.Fprintln(w, `\ No newline at end of file`); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
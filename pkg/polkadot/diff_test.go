@@ -0,0 +1,157 @@
+package polkadot
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/fatih/color"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	color.NoColor = true
+
+	t.Run("identical", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeUnifiedDiff(&buf, "a", "b", []byte("aaa\nbbb\n"), []byte("aaa\nbbb\n")); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("expected no output, got %q", buf.String())
+		}
+	})
+
+	t.Run("modified_line", func(t *testing.T) {
+		var buf bytes.Buffer
+		oldContent := []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n")
+		newContent := []byte("1\n2\n3\n4\nfive\n6\n7\n8\n9\n")
+		if err := writeUnifiedDiff(&buf, "a", "b", oldContent, newContent); err != nil {
+			t.Fatal(err)
+		}
+		want := "--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("new_file", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeUnifiedDiff(&buf, "/dev/null", "b", nil, []byte("aaa\nbbb\n")); err != nil {
+			t.Fatal(err)
+		}
+		want := "--- /dev/null\n+++ b\n@@ -0,0 +1,2 @@\n+aaa\n+bbb\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("separate_hunks", func(t *testing.T) {
+		var buf bytes.Buffer
+		oldContent := []byte("a\n1\n2\n3\n4\n5\n6\n7\nb\n")
+		newContent := []byte("A\n1\n2\n3\n4\n5\n6\n7\nB\n")
+		if err := writeUnifiedDiff(&buf, "a", "b", oldContent, newContent); err != nil {
+			t.Fatal(err)
+		}
+		want := "--- a\n+++ b\n@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -6,4 +6,4 @@\n 5\n 6\n 7\n-b\n+B\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("no_newline_at_eof", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := writeUnifiedDiff(&buf, "a", "b", []byte("aaa\n"), []byte("aaa")); err != nil {
+			t.Fatal(err)
+		}
+		want := "--- a\n+++ b\n@@ -1 +1 @@\n-aaa\n+aaa\n\\ No newline at end of file\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+	})
+}
+
+func TestDiffLines(t *testing.T) {
+	t.Run("shortest", func(t *testing.T) {
+		// GIVEN random line slices over a small alphabet
+		rng := rand.New(rand.NewSource(1))
+		randomLines := func() []string {
+			lines := make([]string, rng.Intn(12))
+			for i := range lines {
+				lines[i] = string(rune('a' + rng.Intn(3)))
+			}
+			return lines
+		}
+		for i := 0; i < 500; i++ {
+			a, b := randomLines(), randomLines()
+
+			// WHEN diffed
+			ops := diffLines(a, b)
+
+			// THEN the script turns a into b with as few changes as possible
+			var gotA, gotB []string
+			changes := 0
+			for _, op := range ops {
+				if op.Kind != diffInsert {
+					gotA = append(gotA, op.Line)
+				}
+				if op.Kind != diffDelete {
+					gotB = append(gotB, op.Line)
+				}
+				if op.Kind != diffEqual {
+					changes++
+				}
+			}
+			if !slices.Equal(gotA, a) || !slices.Equal(gotB, b) {
+				t.Fatalf("%q -> %q: got %+v", a, b, ops)
+			}
+			if want := len(a) + len(b) - 2*lcsLength(a, b); changes != want {
+				t.Fatalf("%q -> %q: got %d changes, want %d", a, b, changes, want)
+			}
+		}
+	})
+
+	t.Run("linear_space", func(t *testing.T) {
+		// GIVEN a file of 3000 lines rewritten completely
+		a := make([]string, 3000)
+		b := make([]string, 3000)
+		for i := range a {
+			a[i] = fmt.Sprintf("old %d\n", i)
+			b[i] = fmt.Sprintf("new %d\n", i)
+		}
+
+		// WHEN diffed
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		ops := diffLines(a, b)
+		runtime.ReadMemStats(&after)
+
+		// THEN the memory does not grow with the square of the lines
+		if len(ops) != 6000 {
+			t.Errorf("got %d ops, want 6000", len(ops))
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Errorf("allocated %d bytes", allocated)
+		}
+	})
+}
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	row := make([]int, len(b)+1)
+	for i := range a {
+		prev := 0
+		for j := range b {
+			cur := row[j+1]
+			if a[i] == b[j] {
+				row[j+1] = prev + 1
+			} else {
+				row[j+1] = max(row[j+1], row[j])
+			}
+			prev = cur
+		}
+	}
+	return row[len(b)]
+}
@@ -0,0 +1,65 @@
+package polkadot
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Front matter
+
+// FrontMatter is the YAML block which may open a fragment of a component with
+// front_matter: true, between two --- lines. It is not part of the output.
+type FrontMatter struct {
+	Description string
+	// Tags are required in addition to the tags of the name. They are tag
+	// expressions, e.g. -darwin or bash+zsh, even in a component without
+	// tag_expressions.
+	Tags []string
+	// Priority orders the sources of a target, lowest first, before their
+	// names.
+	Priority int
+	// Template renders the fragment like a gtp one.
+	Template bool
+	// Delims are the left and right delimiters of the template, {{ and }} if
+	// empty.
+	Delims []string
+	// lines is the number of lines of the block, including the --- lines.
+	lines int
+}
+
+var frontMatterFence = []byte("---")
+
+// splitFrontMatter returns the front matter of a fragment, nil if it has
+// none, and the content which follows it.
+func splitFrontMatter(content []byte) (*FrontMatter, []byte, error) {
+	first, rest, found := bytes.Cut(content, []byte("\n"))
+	if !found || !bytes.Equal(bytes.TrimRight(first, "\r"), frontMatterFence) {
+		return nil, content, nil
+	}
+	var block []byte
+	lines := 1
+	for {
+		line, next, found := bytes.Cut(rest, []byte("\n"))
+		lines++
+		if bytes.Equal(bytes.TrimRight(line, "\r"), frontMatterFence) {
+			rest = next
+			break
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("front matter: missing closing ---")
+		}
+		block = append(block, line...)
+		block = append(block, '\n')
+		rest = next
+	}
+	frontMatter := FrontMatter{lines: lines}
+	if err := yaml.UnmarshalStrict(block, &frontMatter); err != nil {
+		return nil, nil, fmt.Errorf("front matter: %w", err)
+	}
+	if len(frontMatter.Delims) != 0 && len(frontMatter.Delims) != 2 {
+		return nil, nil, fmt.Errorf("front matter: delims must be a left and a right delimiter")
+	}
+	return &frontMatter, rest, nil
+}
@@ -0,0 +1,58 @@
+package polkadot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		for _, content := range []string{"", "export A=1\n", "---", "--- \nnot a fence\n"} {
+			frontMatter, body, err := splitFrontMatter([]byte(content))
+			if err != nil || frontMatter != nil || string(body) != content {
+				t.Errorf("%q: got %v, %q, %v, want no front matter", content, frontMatter, body, err)
+			}
+		}
+	})
+
+	t.Run("block", func(t *testing.T) {
+		content := "---\r\ndescription: prompt\ntags: [bash+zsh, -darwin]\npriority: -10\ntemplate: true\ndelims: ['[[', ']]']\n---\nPS1=[[.host]]\n"
+		frontMatter, body, err := splitFrontMatter([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := FrontMatter{
+			Description: "prompt",
+			Tags:        []string{"bash+zsh", "-darwin"},
+			Priority:    -10,
+			Template:    true,
+			Delims:      []string{"[[", "]]"},
+			lines:       7,
+		}
+		if !reflect.DeepEqual(*frontMatter, want) {
+			t.Errorf("got %+v, want %+v", *frontMatter, want)
+		}
+		if string(body) != "PS1=[[.host]]\n" {
+			t.Errorf("got %q, want %q", body, "PS1=[[.host]]\n")
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		frontMatter, body, err := splitFrontMatter([]byte("---\n---"))
+		if err != nil || frontMatter == nil || frontMatter.lines != 2 || len(body) != 0 {
+			t.Errorf("got %+v, %q, %v, want an empty front matter", frontMatter, body, err)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for content, want := range map[string]string{
+			"---\ntags: [a]\n":             "front matter: missing closing ---",
+			"---\ndelims: ['[[']\n---\n":   "front matter: delims must be a left and a right delimiter",
+			"---\npriorty: 1\n---\nbody\n": "front matter: yaml: unmarshal errors:\n  line 1: field priorty not found in type polkadot.FrontMatter",
+		} {
+			if _, _, err := splitFrontMatter([]byte(content)); err == nil || err.Error() != want {
+				t.Errorf("%q: got %v, want %s", content, err, want)
+			}
+		}
+	})
+}
@@ -0,0 +1,315 @@
+package polkadot
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Lint
+
+// LintIssue is a problem found by Lint at Line of Path, or in the whole file
+// if Line is 0. A Warning may be intended.
+type LintIssue struct {
+	Path    string
+	Line    int
+	Message string
+	Warning bool
+}
+
+func (i LintIssue) String() string {
+	message := i.Message
+	if i.Warning {
+		message = "warning: " + message
+	}
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s", i.Path, message)
+	}
+	return fmt.Sprintf("%s:%d: %s", i.Path, i.Line, message)
+}
+
+// Lint checks the component dirs without probing the system or generating
+// anything. It reports the tags which the templates, gtp or by their front
+// matter, and the partials refer to but entry.yml, tags.yml and paths.yml
+// never define, and the fragment names with such tags.
+func (a *App) Lint() ([]LintIssue, error) {
+	if err := a.LoadComponents(); err != nil {
+		return nil, err
+	}
+	defined, err := a.definedTags()
+	if err != nil {
+		return nil, err
+	}
+	issues, templates, err := a.lintFragmentNames(defined)
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range a.components {
+		err := fs.WalkDir(component.FS, ".", func(fsPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if fsPath != "." && strings.HasPrefix(d.Name(), ".") {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			diskPath := filepath.Join(component.Path, filepath.FromSlash(fsPath))
+			isPartial := strings.HasPrefix(fsPath, partialsDirName+"/")
+			if !isPartial && !templates[diskPath] && !stringInSlice("gtp", extractTagsFromPath(fsPath, component.TagSyntax, false)) {
+				return nil
+			}
+			content, err := fs.ReadFile(component.FS, fsPath)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", diskPath, err)
+			}
+			tpl := template.New(path.Base(fsPath)).Funcs(templateFuncs(nil))
+			lineOffset := 0
+			if component.FrontMatter && !isPartial {
+				frontMatter, body, err := splitFrontMatter(content)
+				if err != nil {
+					issues = append(issues, LintIssue{Path: diskPath, Message: err.Error()})
+					return nil
+				}
+				if frontMatter != nil {
+					content = body
+					lineOffset = frontMatter.lines
+					if len(frontMatter.Delims) == 2 {
+						tpl = tpl.Delims(frontMatter.Delims[0], frontMatter.Delims[1])
+					}
+				}
+			}
+			if _, err := tpl.Parse(string(content)); err != nil {
+				issues = append(issues, LintIssue{Path: diskPath, Message: err.Error()})
+				return nil
+			}
+			for _, ref := range templateTagRefs(tpl) {
+				if _, ok := defined[ref.tag]; !ok {
+					issues = append(issues, LintIssue{Path: diskPath, Line: ref.line + lineOffset, Message: fmt.Sprintf("undefined tag %q", ref.tag)})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(issues, func(a, b LintIssue) int {
+		if a.Path != b.Path {
+			return cmp.Compare(a.Path, b.Path)
+		}
+		if a.Line != b.Line {
+			return cmp.Compare(a.Line, b.Line)
+		}
+		return cmp.Compare(a.Message, b.Message)
+	})
+	return slices.Compact(issues), nil
+}
+
+// lintFragmentNames warns about the tags of the fragment names which are
+// defined nowhere: a part of the name may have been taken for a tag, e.g. the
+// completion of git_completion.sh, unless the tag is set on other hosts. Only
+// the files matching a rule are fragments; rule directories which are
+// templates are skipped. It also returns the paths of the fragments which are
+// templates, by their tags or their front matter.
+func (a *App) lintFragmentNames(defined map[string]bool) ([]LintIssue, map[string]bool, error) {
+	ruleConfMap, err := a.LoadRules()
+	if err != nil {
+		return nil, nil, err
+	}
+	templates := make(map[string]bool)
+	var issues []LintIssue
+	for _, component := range a.components {
+		weaver := Weaver{Record: true}
+		for _, ruleConf := range ruleConfMap {
+			for _, dir := range ruleConf.Directories {
+				if strings.Contains(dir, "{{") {
+					continue
+				}
+				if _, err := weaver.Walk(component, dir, nil, ruleConf); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		for _, explanation := range weaver.Explanations {
+			if !explanation.PatternMatched {
+				continue
+			}
+			if explanation.Source.IsTemplate() {
+				templates[explanation.Source.Path] = true
+			}
+			for i, tag := range explanation.Source.Tags {
+				terms := explanation.Source.tagTerms(component, i)
+				if slices.ContainsFunc(terms, func(term tagTerm) bool { return term.name == "" }) {
+					message := fmt.Sprintf("tag %q has an empty alternative (escape a + of a name as %%2B, a leading - as %%2D)", tag)
+					issues = append(issues, LintIssue{Path: explanation.Source.Path, Message: message, Warning: true})
+				}
+				for _, term := range terms {
+					if term.name == "" || defined[term.name] {
+						continue
+					}
+					message := fmt.Sprintf("tag %q is defined nowhere", term.name)
+					if component.TagSyntax == TagSyntaxUnderscore {
+						message += " (if it is a part of the name, set tag_syntax in component.yml)"
+					}
+					issues = append(issues, LintIssue{Path: explanation.Source.Path, Message: message, Warning: true})
+				}
+			}
+		}
+	}
+	return issues, templates, nil
+}
+
+// definedTags returns every tag which entry.yml, tags.yml or paths.yml
+// mention, whether accepted or rejected.
+func (a *App) definedTags() (map[string]bool, error) {
+	// the built-in tags of Prepare
+	defined := map[string]bool{"default": true, "dotfiles": true, "gtp": true}
+	entryTags, err := a.LoadEntry()
+	if err != nil {
+		return nil, err
+	}
+	for tag := range entryTags {
+		defined[strings.TrimLeft(tag, "!")] = true
+	}
+	tagConf, _, _, err := a.LoadTags()
+	if err != nil {
+		return nil, err
+	}
+	for tag, children := range tagConf {
+		defined[strings.TrimLeft(tag, "!")] = true
+		for child := range children {
+			defined[strings.TrimLeft(child, "!")] = true
+		}
+	}
+	for _, component := range a.components {
+		confPath := filepath.Join(component.Path, "paths.yml")
+		buf, err := fs.ReadFile(component.FS, "paths.yml")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", confPath, err)
+		}
+		var pathsConf PathsConf
+		if err := yaml.Unmarshal(buf, &pathsConf); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", confPath, err)
+		}
+		for tag := range pathsConf {
+			defined[tag] = true
+		}
+	}
+	return defined, nil
+}
+
+type tagRef struct {
+	tag  string
+	line int
+}
+
+// templateTagRefs returns the tags which tpl and the templates it defines
+// refer to: {{.tag}}, {{$.tag}}, {{index . "tag"}} and {{hasTag "tag"}}.
+// Fields of a dot changed by range or with are not tags.
+func templateTagRefs(tpl *template.Template) []tagRef {
+	var refs []tagRef
+	for _, t := range tpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		tree := t.Tree
+		add := func(node parse.Node, tag string) {
+			location, _ := tree.ErrorContext(node)
+			parts := strings.Split(location, ":")
+			line, _ := strconv.Atoi(parts[len(parts)-2])
+			refs = append(refs, tagRef{tag: tag, line: line})
+		}
+		var walk func(node parse.Node, dotIsTags bool)
+		walk = func(node parse.Node, dotIsTags bool) {
+			switch n := node.(type) {
+			case *parse.ListNode:
+				if n == nil {
+					return
+				}
+				for _, child := range n.Nodes {
+					walk(child, dotIsTags)
+				}
+			case *parse.ActionNode:
+				walk(n.Pipe, dotIsTags)
+			case *parse.PipeNode:
+				if n == nil {
+					return
+				}
+				for _, cmd := range n.Cmds {
+					walk(cmd, dotIsTags)
+				}
+			case *parse.CommandNode:
+				if len(n.Args) >= 2 {
+					if ident, ok := n.Args[0].(*parse.IdentifierNode); ok {
+						switch {
+						case ident.Ident == "hasTag":
+							if s, ok := n.Args[1].(*parse.StringNode); ok {
+								add(s, s.Text)
+							}
+						case ident.Ident == "index" && len(n.Args) >= 3 && isTagMap(n.Args[1], dotIsTags):
+							if s, ok := n.Args[2].(*parse.StringNode); ok {
+								add(s, s.Text)
+							}
+						}
+					}
+				}
+				for _, arg := range n.Args {
+					walk(arg, dotIsTags)
+				}
+			case *parse.FieldNode:
+				if dotIsTags {
+					add(n, n.Ident[0])
+				}
+			case *parse.VariableNode:
+				if n.Ident[0] == "$" && len(n.Ident) > 1 {
+					add(n, n.Ident[1])
+				}
+			case *parse.ChainNode:
+				walk(n.Node, dotIsTags)
+			case *parse.IfNode:
+				walk(n.Pipe, dotIsTags)
+				walk(n.List, dotIsTags)
+				walk(n.ElseList, dotIsTags)
+			case *parse.RangeNode:
+				walk(n.Pipe, dotIsTags)
+				walk(n.List, false)
+				walk(n.ElseList, dotIsTags)
+			case *parse.WithNode:
+				walk(n.Pipe, dotIsTags)
+				walk(n.List, false)
+				walk(n.ElseList, dotIsTags)
+			case *parse.TemplateNode:
+				walk(n.Pipe, dotIsTags)
+			}
+		}
+		walk(tree.Root, true)
+	}
+	return refs
+}
+
+// isTagMap tells whether node evaluates to the tag map: the dot, if it was
+// not changed, or $.
+func isTagMap(node parse.Node, dotIsTags bool) bool {
+	switch n := node.(type) {
+	case *parse.DotNode:
+		return dotIsTags
+	case *parse.VariableNode:
+		return len(n.Ident) == 1 && n.Ident[0] == "$"
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package polkadot
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLint(t *testing.T) {
+	t.Run("undefined_tags", func(t *testing.T) {
+		// GIVEN tags defined by entry.yml, tags.yml and paths.yml
+		dotfilesFS := fstest.MapFS{
+			"entry.yml": {Data: []byte("linux:\n\"!work\":\n")},
+		}
+		componentFS := fstest.MapFS{
+			"tags.yml":  {Data: []byte("linux:\n  editor: vi\n")},
+			"paths.yml": {Data: []byte("emacs:\n  - type: exec\n")},
+			"bash/10-editor_gtp.sh": {Data: []byte(`export EDITOR={{.editor}}
+{{if hasTag "work"}}{{.emcas}}{{end}}
+{{range .paths}}{{.name}}{{end}}{{index $ "shlel"}}
+`)},
+			"bash/20-plain.sh":        {Data: []byte("{{.ignored}}\n")},
+			"partials/prompt.tmpl":    {Data: []byte(`{{define "ps1"}}{{$.colour}}{{end}}{{.default}}`)},
+			".git/hooks/pre_gtp.tmpl": {Data: []byte("{{.hidden}}\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  dotfilesFS,
+			Components:  []Component{{Path: "common", FS: componentFS}},
+		})
+
+		// WHEN linted
+		issues, err := app.Lint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN only the references to undefined tags are reported
+		var got []string
+		for _, issue := range issues {
+			got = append(got, issue.String())
+		}
+		want := []string{
+			`common/bash/10-editor_gtp.sh:2: undefined tag "emcas"`,
+			`common/bash/10-editor_gtp.sh:3: undefined tag "paths"`,
+			`common/bash/10-editor_gtp.sh:3: undefined tag "shlel"`,
+			`common/partials/prompt.tmpl:1: undefined tag "colour"`,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("parse_error", func(t *testing.T) {
+		componentFS := fstest.MapFS{
+			"bash/30-broken_gtp.sh": {Data: []byte("{{.linux\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+		})
+		issues, err := app.Lint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(issues) != 1 || issues[0].Path != "common/bash/30-broken_gtp.sh" {
+			t.Errorf("got %v, want a parse error of common/bash/30-broken_gtp.sh", issues)
+		}
+	})
+	t.Run("fragment_names", func(t *testing.T) {
+		// GIVEN a fragment whose name looks tagged, tag expressions, and
+		// fragments of a component with another tag syntax and plain tags
+		dotfilesFS := fstest.MapFS{"entry.yml": {Data: []byte("bash:\n")}}
+		common := fstest.MapFS{
+			"component.yml":            {Data: []byte("tag_expressions: true\n")},
+			"rules.yml":                {Data: []byte("~/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/git_completion.sh":   {Data: []byte("complete\n")},
+			"bash/prompt_bash+-zsh.sh": {Data: []byte("prompt\n")},
+			"bash/vim_bash+.sh":        {Data: []byte("vim\n")},
+			"bash/README_ja.md":        {Data: []byte("not a fragment\n")},
+		}
+		host := fstest.MapFS{
+			"component.yml":              {Data: []byte("tag_syntax: braces\n")},
+			"bash/host_aliases.{bsh}.sh": {Data: []byte("aliases\n")},
+			"bash/host_cc.{c++}.sh":      {Data: []byte("cc\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  dotfilesFS,
+			Components:  []Component{{Path: "common", FS: common}, {Path: "host", FS: host}},
+		})
+
+		// WHEN linted
+		issues, err := app.Lint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the tags defined nowhere are reported
+		var got []string
+		for _, issue := range issues {
+			got = append(got, issue.String())
+		}
+		want := []string{
+			`common/bash/git_completion.sh: warning: tag "completion" is defined nowhere (if it is a part of the name, set tag_syntax in component.yml)`,
+			`common/bash/prompt_bash+-zsh.sh: warning: tag "zsh" is defined nowhere (if it is a part of the name, set tag_syntax in component.yml)`,
+			`common/bash/vim_bash+.sh: warning: tag "bash+" has an empty alternative (escape a + of a name as %2B, a leading - as %2D)`,
+			`host/bash/host_aliases.{bsh}.sh: warning: tag "bsh" is defined nowhere`,
+			`host/bash/host_cc.{c++}.sh: warning: tag "c++" is defined nowhere`,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("front_matter", func(t *testing.T) {
+		// GIVEN fragments whose front matter makes them templates, or is broken
+		componentFS := fstest.MapFS{
+			"component.yml":   {Data: []byte("front_matter: true\n")},
+			"rules.yml":       {Data: []byte("~/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/prompt.sh":  {Data: []byte("---\ntemplate: true\ndelims: ['<%', '%>']\n---\nPS1=<% .linux %>{{.ignored}}\n<% .hostnmae %>\n")},
+			"bash/env_gtp.sh": {Data: []byte("---\ndescription: env\n---\nEDITOR={{.editr}}\n")},
+			"bash/broken.sh":  {Data: []byte("---\ntags: [linux]\n")},
+			"bash/plain.sh":   {Data: []byte("{{.ignored}}\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+		})
+
+		// WHEN linted
+		issues, err := app.Lint()
+
+		// THEN the walk of the rules fails on the broken front matter
+		want := "walk common/bash: common/bash/broken.sh: front matter: missing closing ---"
+		if err == nil || err.Error() != want {
+			t.Fatalf("got %v, %v, want %s", issues, err, want)
+		}
+
+		// WHEN it is fixed
+		componentFS["bash/broken.sh"] = &fstest.MapFile{Data: []byte("---\ntags: [linux]\n---\n")}
+		issues, err = app.Lint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the lines of the templates count the front matter
+		var got []string
+		for _, issue := range issues {
+			got = append(got, issue.String())
+		}
+		wantIssues := []string{
+			`common/bash/env_gtp.sh:4: undefined tag "editr"`,
+			`common/bash/prompt.sh:6: undefined tag "hostnmae"`,
+		}
+		if !reflect.DeepEqual(got, wantIssues) {
+			t.Errorf("got %q, want %q", got, wantIssues)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package polkadot
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Manifest
+
+const (
+	// StateDirName is the directory under the dotfiles root where the
+	// manifest and the backups are kept unless Options.StateDir is set.
+	StateDirName     = ".polkadot"
+	manifestFileName = "manifest.json"
+)
+
+// Manifest records what the last runs generated so that later runs can find
+// targets which are no longer produced by any rule.
+type Manifest struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Tags        map[string]string `json:"tags"`
+	Targets     []ManifestTarget  `json:"targets"`
+}
+
+// ManifestTarget is the record of one generated target.
+type ManifestTarget struct {
+	Path    string   `json:"path"` // with ~/ expanded
+	Rule    string   `json:"rule"` // as written in rules.yml
+	Mode    string   `json:"mode"` // octal, like rules.yml
+	Hash    string   `json:"hash"`
+	Link    string   `json:"link,omitempty"` // the source a link target points to
+	Sources []string `json:"sources"`
+}
+
+// LoadManifest reads the manifest at path. A missing file yields an empty
+// manifest.
+func LoadManifest(path string) (*Manifest, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// Save writes the manifest to path, creating its directory.
+func (m *Manifest) Save(path string) error {
+	slices.SortFunc(m.Targets, func(a, b ManifestTarget) int {
+		return cmp.Compare(a.Path, b.Path)
+	})
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	if err := os.WriteFile(path, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+// Lookup returns the record of the target at path, given with ~/ expanded.
+func (m *Manifest) Lookup(path string) (ManifestTarget, bool) {
+	for _, target := range m.Targets {
+		if target.Path == path {
+			return target, true
+		}
+	}
+	return ManifestTarget{}, false
+}
+
+// Record adds target to the manifest, replacing any record for the same path.
+func (m *Manifest) Record(target ManifestTarget) {
+	for i := range m.Targets {
+		if m.Targets[i].Path == target.Path {
+			m.Targets[i] = target
+			return
+		}
+	}
+	m.Targets = append(m.Targets, target)
+}
+
+func hashContent(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,56 @@
+package polkadot
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	t.Run("load/missing", func(t *testing.T) {
+		m, err := LoadManifest(filepath.Join(t.TempDir(), "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Targets) != 0 {
+			t.Errorf("expected no targets, got %v", m.Targets)
+		}
+	})
+
+	t.Run("record/replaces_same_path", func(t *testing.T) {
+		m := &Manifest{}
+		m.Record(ManifestTarget{Path: "/a", Hash: "1"})
+		m.Record(ManifestTarget{Path: "/b", Hash: "2"})
+		m.Record(ManifestTarget{Path: "/a", Hash: "3"})
+		if len(m.Targets) != 2 {
+			t.Fatalf("expected 2 targets, got %d", len(m.Targets))
+		}
+		if target, _ := m.Lookup("/a"); target.Hash != "3" {
+			t.Errorf("got hash %q, want %q", target.Hash, "3")
+		}
+	})
+
+	t.Run("save/round_trip", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "state", "manifest.json")
+		m := &Manifest{
+			Tags: map[string]string{"linux": "linux"},
+			Targets: []ManifestTarget{
+				{Path: "/b", Rule: "/b", Mode: "0644", Hash: "2", Sources: []string{"c/b.sh"}},
+				{Path: "/a", Rule: "/a", Mode: "0600", Hash: "1", Sources: []string{"c/a.sh"}},
+			},
+		}
+		if err := m.Save(p); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadManifest(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(loaded.Targets, m.Targets) {
+			t.Errorf("got %v, want %v", loaded.Targets, m.Targets)
+		}
+		if loaded.Targets[0].Path != "/a" {
+			t.Errorf("expected targets sorted by path, got %v", loaded.Targets)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package polkadot
+
+import (
+	"fmt"
+)
+
+// Plan
+
+// Plan is the machine-readable summary of what Prepare resolved.
+type Plan struct {
+	Tags         map[string]string `json:"tags"`
+	AcceptedTags map[string]string `json:"accepted_tags"`
+	RejectedTags map[string]string `json:"rejected_tags"`
+	Entries      []PlanEntry       `json:"entries"`
+}
+
+// PlanEntry is a target and the sources it is woven from.
+type PlanEntry struct {
+	Target  string       `json:"target"` // as written in rules.yml
+	Path    string       `json:"path"`   // resolved, see TargetPaths
+	Mode    *string      `json:"mode"`   // octal, null if the rule sets none
+	Link    bool         `json:"link"`   // the rule asks for a symbolic link
+	Sources []PlanSource `json:"sources"`
+}
+
+// PlanSource is a fragment of a target.
+type PlanSource struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Tags     []string `json:"tags"`
+	Template bool     `json:"template"`
+}
+
+// TargetResult is the machine-readable outcome of one generated target.
+type TargetResult struct {
+	Path    string  `json:"path"`
+	Mode    string  `json:"mode,omitempty"` // octal, unset for links
+	Hash    string  `json:"hash,omitempty"`
+	Link    string  `json:"link,omitempty"` // the source a link points to
+	Outcome Outcome `json:"outcome"`
+}
+
+// Plan returns the tags and the entries resolved by Prepare.
+func (a *App) Plan() (Plan, error) {
+	plan := Plan{
+		Tags:         a.tagMap,
+		AcceptedTags: a.acceptedTags,
+		RejectedTags: a.rejectedTags,
+		Entries:      make([]PlanEntry, 0, len(a.dotEntries)),
+	}
+	for _, entry := range a.dotEntries {
+		outFilePath, err := a.paths.Resolve(entry.Path())
+		if err != nil {
+			return Plan{}, err
+		}
+		planEntry := PlanEntry{
+			Target:  entry.Path(),
+			Path:    outFilePath,
+			Link:    entry.Target.Link,
+			Sources: make([]PlanSource, 0, len(entry.Sources)),
+		}
+		if entry.Target.Mode != nil {
+			mode := fmt.Sprintf("%04o", *entry.Target.Mode)
+			planEntry.Mode = &mode
+		}
+		for _, source := range entry.Sources {
+			planEntry.Sources = append(planEntry.Sources, PlanSource{
+				Name:     source.Name,
+				Path:     source.Path,
+				Tags:     source.Tags,
+				Template: source.IsTemplate(),
+			})
+		}
+		plan.Entries = append(plan.Entries, planEntry)
+	}
+	return plan, nil
+}
+
+// Results returns the outcome of every target handled by Execute.
+func (a *App) Results() []TargetResult {
+	results := make([]TargetResult, 0, len(a.results))
+	for _, result := range a.results {
+		targetResult := TargetResult{
+			Path:    result.Path,
+			Hash:    result.Hash,
+			Link:    result.Link,
+			Outcome: result.Outcome,
+		}
+		if result.Link == "" {
+			targetResult.Mode = fmt.Sprintf("%04o", result.Mode)
+		}
+		results = append(results, targetResult)
+	}
+	return results
+}
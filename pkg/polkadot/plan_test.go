@@ -0,0 +1,56 @@
+package polkadot
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	mode := 0600
+	app := App{
+		tagMap:       map[string]string{"linux": "linux"},
+		acceptedTags: map[string]string{"linux": "linux"},
+		rejectedTags: map[string]string{"emacs": "!emacs"},
+		dotEntries: []DotEntry{{
+			Sources: []DotSource{
+				{Name: "a.sh", Path: "c/bash/a.sh", Tags: []string{}},
+				{Name: "b_gtp.sh", Path: "c/bash/b_gtp.sh", Tags: []string{"gtp"}},
+			},
+			Target: DotTarget{Path: "/tmp/bashrc", Mode: &mode},
+		}},
+		results: []GenerateResult{{Path: "/tmp/bashrc", Mode: 0600, Hash: "sha256:00", Outcome: OutcomeModeChanged}},
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		plan, err := app.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plan.Entries) != 1 {
+			t.Fatalf("expected 1 entry, got %d", len(plan.Entries))
+		}
+		entry := plan.Entries[0]
+		if entry.Mode == nil || *entry.Mode != "0600" {
+			t.Errorf("got mode %v, want %q", entry.Mode, "0600")
+		}
+		var templates []bool
+		for _, source := range entry.Sources {
+			templates = append(templates, source.Template)
+		}
+		if !reflect.DeepEqual(templates, []bool{false, true}) {
+			t.Errorf("got templates %v, want %v", templates, []bool{false, true})
+		}
+	})
+
+	t.Run("results/json", func(t *testing.T) {
+		buf, err := json.Marshal(app.Results())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `[{"path":"/tmp/bashrc","mode":"0600","hash":"sha256:00","outcome":"mode changed"}]`
+		if string(buf) != want {
+			t.Errorf("got %s, want %s", buf, want)
+		}
+	})
+}
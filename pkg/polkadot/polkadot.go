@@ -0,0 +1,2463 @@
+// Package polkadot generates dotfiles from fragments spread across component
+// directories, selected and rendered according to the tags of the machine.
+//
+// An App is created from Options with New. Prepare resolves the tags and
+// weaves the sources of every target, Plan describes the result, Execute
+// writes the targets and Results reports what happened to each of them.
+package polkadot
+
+import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fatih/color"
+	"gopkg.in/yaml.v2"
+)
+
+// Application
+
+// Options configures an App.
+type Options struct {
+	// DotfilesDir is the dotfiles root, exposed to templates as the dotfiles
+	// tag.
+	DotfilesDir string
+	// DotfilesFS is where entry.yml is read, os.DirFS(DotfilesDir) if nil.
+	DotfilesFS fs.FS
+	// EntryPath is the path of entry.yml in DotfilesFS, entry.yml if empty.
+	EntryPath string
+	// Components are scanned in order; later ones override earlier ones.
+	Components []Component
+	// StateDir holds the manifest and the backups. If empty, it is
+	// DestDir/.polkadot, Home/.polkadot or DotfilesDir/.polkadot when the
+	// targets are on the disk; otherwise, e.g. with Targets in memory, nothing
+	// is kept.
+	StateDir string
+	// RawConcat concatenates fragments without normalizing newlines.
+	RawConcat bool
+	// Strict fails on tags missing from the tag map in gtp fragments, unless
+	// a rule sets strict.
+	Strict bool
+	// Force overwrites targets edited since they were last generated.
+	Force bool
+	// KeepEdits copies edited targets into the state directory before
+	// overwriting them.
+	KeepEdits bool
+	// Targets reads and writes the targets, the disk if nil.
+	Targets TargetFS
+	// Home is what ~/ expands to in target paths, the home directory of the
+	// user if empty. The probes of paths.yml always use the latter. StateDir
+	// then defaults to Home/.polkadot, so that a staged home is never pruned
+	// against the manifest of the real one.
+	Home string
+	// DestDir, if set, is prepended to every target path. StateDir then
+	// defaults to DestDir/.polkadot, keeping the real state untouched.
+	DestDir string
+	// Out receives the progress output: targets, outcomes and warnings.
+	// Nothing is printed if nil.
+	Out io.Writer
+	// Logger receives debug messages such as the resolved tags. Nothing is
+	// logged if nil.
+	Logger *log.Logger
+}
+
+// Component is a component directory. Path names it in messages and in the
+// manifest; its files are read through FS.
+type Component struct {
+	Path string
+	FS   fs.FS
+	// Dir is the directory of FS on the disk, if any. Link rules need it.
+	Dir string
+	// TagSyntax is how its fragment names encode their tags. If empty,
+	// LoadComponents reads it from the component.yml of the component, like
+	// FrontMatter if false.
+	TagSyntax TagSyntax
+	// FrontMatter makes its fragments start with a FrontMatter, if any.
+	FrontMatter bool
+	// TagExpressions makes the tags of its fragments expressions (see
+	// tagSatisfied) instead of plain tag names.
+	TagExpressions bool
+}
+
+// DirComponent returns the component directory at path on the disk.
+func DirComponent(path string) Component {
+	return Component{Path: path, FS: os.DirFS(path), Dir: path}
+}
+
+// App runs the pipeline for one dotfiles root: Prepare loads, expands,
+// collects and weaves, then Execute generates the targets.
+type App struct {
+	// Input
+	dotfilesDirPath string
+	dotfilesFS      fs.FS
+	entryPath       string
+	components      []Component
+	stateDirPath    string
+	targets         TargetFS // the disk if nil
+	paths           TargetPaths
+	out             io.Writer // progress output, discarded if nil
+	logger          *log.Logger
+	// Load
+	entryTags     map[string]string
+	tagConf       map[string]map[string]string
+	tagConditions map[string]map[string]Condition
+	tagConfPaths  map[string]string
+	ruleConfMap   map[string]WeaverRule
+	partials      *template.Template
+	manifest      *Manifest
+	// Expand
+	acceptedTags map[string]string
+	rejectedTags map[string]string
+	// Collect
+	collectedTags map[string]string
+	tagMap        map[string]string
+	tagProvenance map[string][]TagRecord
+	// Weave
+	dotEntries   []DotEntry
+	explanations []Explanation
+	// Generate
+	rawConcat bool
+	strict    bool
+	force     bool
+	keepEdits bool
+	results   []GenerateResult
+	// Prune
+	pruned []string
+	// backup is shared by Generate and Prune, so that one rollback undoes
+	// both, see backupRun.
+	backup *BackupRun
+}
+
+// New returns an App configured by opts. Nothing is read until Prepare.
+func New(opts Options) *App {
+	dotfilesFS := opts.DotfilesFS
+	if dotfilesFS == nil {
+		dotfilesFS = os.DirFS(opts.DotfilesDir)
+	}
+	entryPath := opts.EntryPath
+	if entryPath == "" {
+		entryPath = "entry.yml"
+	}
+	stateDirPath := opts.StateDir
+	switch {
+	case stateDirPath != "", opts.Targets != nil:
+	case opts.DestDir != "":
+		stateDirPath = filepath.Join(opts.DestDir, StateDirName)
+	case opts.Home != "":
+		stateDirPath = filepath.Join(opts.Home, StateDirName)
+	case opts.DotfilesDir != "":
+		stateDirPath = filepath.Join(opts.DotfilesDir, StateDirName)
+	}
+	return &App{
+		dotfilesDirPath: opts.DotfilesDir,
+		dotfilesFS:      dotfilesFS,
+		entryPath:       entryPath,
+		components:      slices.Clone(opts.Components),
+		stateDirPath:    stateDirPath,
+		targets:         opts.Targets,
+		paths:           TargetPaths{Home: opts.Home, Root: opts.DestDir},
+		out:             opts.Out,
+		logger:          opts.Logger,
+		rawConcat:       opts.RawConcat,
+		strict:          opts.Strict,
+		force:           opts.Force,
+		keepEdits:       opts.KeepEdits,
+	}
+}
+
+func (a *App) stdout() io.Writer {
+	if a.out == nil {
+		return io.Discard
+	}
+	return a.out
+}
+
+func (a *App) componentPaths() []string {
+	paths := make([]string, 0, len(a.components))
+	for _, component := range a.components {
+		paths = append(paths, component.Path)
+	}
+	return paths
+}
+
+func (a *App) logf(format string, v ...any) {
+	if a.logger != nil {
+		a.logger.Printf(format, v...)
+	}
+}
+
+// Prepare loads the configuration and resolves the tags and the sources of
+// every target, without writing anything.
+func (a *App) Prepare() error {
+	a.logf("dotfiles dir: %s\n", a.dotfilesDirPath)
+	a.logf("component dirs: %+v\n", a.componentPaths())
+
+	if err := a.LoadComponents(); err != nil {
+		return err
+	}
+
+	entryTags, err := a.LoadEntry()
+	if err != nil {
+		return err
+	}
+	entryTags["default"] = "default"
+	a.logf("entry tags: %+v\n", entryTags)
+	a.entryTags = entryTags
+
+	tagConf, tagConditions, tagConfPaths, err := a.LoadTags()
+	if err != nil {
+		return err
+	}
+	a.tagConf = tagConf
+	a.tagConditions = tagConditions
+	a.tagConfPaths = tagConfPaths
+
+	ruleConf, err := a.LoadRules()
+	if err != nil {
+		return err
+	}
+	a.ruleConfMap = ruleConf
+
+	partials, err := a.LoadPartials()
+	if err != nil {
+		return err
+	}
+	a.partials = partials
+
+	a.manifest = &Manifest{}
+	if a.stateDirPath != "" {
+		manifest, err := LoadManifest(a.manifestPath())
+		if err != nil {
+			return err
+		}
+		a.manifest = manifest
+	}
+
+	if err := a.Resolve(); err != nil {
+		return err
+	}
+
+	dotEntries, err := a.Weave()
+	if err != nil {
+		return err
+	}
+	a.dotEntries = dotEntries
+	return nil
+}
+
+// Resolve expands and collects the tags until they settle, so that a probed
+// tag implies its children, and the conditions of the probes and of the
+// implications see the tags of the previous round. It fails if the tags
+// oscillate.
+func (a *App) Resolve() error {
+	builtinRecords := []TagRecord{
+		{Tag: "dotfiles", Value: a.dotfilesDirPath, Source: builtinSource},
+		{Tag: "gtp", Value: "gtp", Source: builtinSource},
+	}
+	a.collectedTags = make(map[string]string)
+	a.tagMap = nil
+	// the tag maps of the previous rounds, each followed by what it collected
+	var rounds []map[string]string
+	for round := 1; ; round++ {
+		acceptedTags, rejectedTags, expandRecords, err := a.Expand()
+		if err != nil {
+			return err
+		}
+		a.logf("round %d: accepted tags: %+v\n", round, acceptedTags)
+		a.logf("round %d: rejected tags: %+v\n", round, rejectedTags)
+		a.acceptedTags = acceptedTags
+		a.rejectedTags = rejectedTags
+
+		tagMap := make(map[string]string)
+		for tag, value := range a.collectedTags {
+			tagMap[tag] = value
+		}
+		for _, record := range builtinRecords {
+			tagMap[record.Tag] = record.Value
+		}
+		for tag, value := range acceptedTags {
+			tagMap[tag] = value
+		}
+		for tag := range rejectedTags {
+			delete(tagMap, tag)
+		}
+		previousTagMap := a.tagMap
+		a.tagMap = tagMap
+
+		collectedTags, collectRecords, err := a.Collect()
+		if err != nil {
+			return err
+		}
+		a.logf("round %d: collected tags: %+v\n", round, collectedTags)
+		if maps.Equal(tagMap, previousTagMap) && maps.Equal(collectedTags, a.collectedTags) {
+			a.logf("resolved tags: %+v\n", tagMap)
+			a.tagProvenance = mergeTagRecords(expandRecords, builtinRecords, collectRecords)
+			return nil
+		}
+		for i := 0; i < len(rounds); i += 2 {
+			if !maps.Equal(tagMap, rounds[i]) || !maps.Equal(collectedTags, rounds[i+1]) {
+				continue
+			}
+			// the rounds since then repeat forever
+			var tags []string
+			cycle := append(rounds[i:], tagMap, collectedTags)
+			for j := 2; j < len(cycle); j++ {
+				tags = append(tags, changedTags(cycle[j-2], cycle[j])...)
+			}
+			slices.Sort(tags)
+			tags = slices.Compact(tags)
+			return fmt.Errorf("resolve tags: the when conditions and paths.yml probes do not settle, %s found and lost in turn", strings.Join(tags, ", "))
+		}
+		rounds = append(rounds, tagMap, collectedTags)
+		a.collectedTags = collectedTags
+	}
+}
+
+// changedTags returns the sorted tags which are in only one of a and b, or
+// have different values.
+func changedTags(a map[string]string, b map[string]string) []string {
+	var tags []string
+	for tag, value := range a {
+		if other, ok := b[tag]; !ok || other != value {
+			tags = append(tags, tag)
+		}
+	}
+	for tag := range b {
+		if _, ok := a[tag]; !ok {
+			tags = append(tags, tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// PrintEntries lists every target with its sources.
+func (a *App) PrintEntries() {
+	a.logf("sources: (following)")
+	for _, entry := range a.dotEntries {
+		if entry.Target.Mode != nil {
+			color.New(color.FgBlue).Fprintf(a.stdout(), "%s (mode: %o)\n", entry.Path(), *entry.Target.Mode)
+		} else {
+			color.New(color.FgBlue).Fprintln(a.stdout(), entry.Path())
+		}
+		for _, source := range entry.Sources {
+			fmt.Fprintln(a.stdout(), "- "+source.Path)
+		}
+	}
+}
+
+// FindEntry returns the entry whose target is path, given either as written
+// in rules.yml or with ~/ expanded.
+func (a *App) FindEntry(path string) (DotEntry, bool) {
+	expandedPath, err := a.paths.Resolve(path)
+	if err != nil {
+		expandedPath = path
+	}
+	for _, entry := range a.dotEntries {
+		if entry.Path() == path {
+			return entry, true
+		}
+		if outFilePath, err := a.paths.Resolve(entry.Path()); err == nil && outFilePath == expandedPath {
+			return entry, true
+		}
+	}
+	return DotEntry{}, false
+}
+
+// Entries returns the targets resolved by Prepare with their sources,
+// sorted by target.
+func (a *App) Entries() []DotEntry {
+	return a.dotEntries
+}
+
+// TagProvenance returns, for each resolved or rejected tag, its declarations,
+// the winning one first.
+func (a *App) TagProvenance() map[string][]TagRecord {
+	return a.tagProvenance
+}
+
+// Explanations returns why each candidate file is or is not a source of each
+// target, sorted by target.
+func (a *App) Explanations() []Explanation {
+	return a.explanations
+}
+
+// Pruned returns the paths removed by Prune, or which it would remove in a
+// dry run.
+func (a *App) Pruned() []string {
+	return a.pruned
+}
+
+// Execute generates every target resolved by Prepare.
+func (a *App) Execute() error {
+	err := a.Generate()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Prune removes the targets recorded in the manifest which the current rules
+// no longer produce. Targets modified since they were generated are kept.
+// The removed targets are backed up in the same run as those of Generate.
+func (a *App) Prune(dryRun bool) error {
+	currentPaths := make(map[string]struct{})
+	for _, entry := range a.dotEntries {
+		outFilePath, err := a.paths.Resolve(entry.Path())
+		if err != nil {
+			return err
+		}
+		currentPaths[outFilePath] = struct{}{}
+	}
+	// shared with Generate; logged here if only Prune saved anything
+	backup := a.backupRun()
+	var backupID string
+	if backup != nil {
+		backupID = backup.ID
+	}
+	keptTargets := make([]ManifestTarget, 0, len(a.manifest.Targets))
+	for _, target := range a.manifest.Targets {
+		if _, ok := currentPaths[target.Path]; ok {
+			keptTargets = append(keptTargets, target)
+			continue
+		}
+		if dryRun {
+			color.New(color.FgYellow).Fprintf(a.stdout(), "would remove %s\n", target.Path)
+			keptTargets = append(keptTargets, target)
+			a.pruned = append(a.pruned, target.Path)
+			continue
+		}
+		removed, err := pruneTarget(a.stdout(), targetFSOrDisk(a.targets), backup, target)
+		if err != nil {
+			return err
+		}
+		if removed {
+			a.pruned = append(a.pruned, target.Path)
+		} else {
+			keptTargets = append(keptTargets, target)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	if backup != nil && backup.ID != backupID {
+		a.logf("backup: %s\n", backup.ID)
+	}
+	a.manifest.Targets = keptTargets
+	return a.saveManifest()
+}
+
+// backupRun returns the BackupRun of this run, created on the first call, or
+// nil without a state directory.
+func (a *App) backupRun() *BackupRun {
+	if a.stateDirPath == "" {
+		return nil
+	}
+	if a.backup == nil {
+		a.backup = NewBackupRun(filepath.Join(a.stateDirPath, backupsDirName), a.manifestPath())
+		a.backup.targets = a.targets
+	}
+	return a.backup
+}
+
+// findConflicts lists the targets whose current contents differ from what
+// polkadot last wrote to them.
+func (a *App) findConflicts() ([]string, error) {
+	var conflicts []string
+	for _, entry := range a.dotEntries {
+		outFilePath, err := a.paths.Resolve(entry.Path())
+		if err != nil {
+			return nil, err
+		}
+		target, ok := a.manifest.Lookup(outFilePath)
+		if !ok {
+			continue
+		}
+		if target.Link != "" {
+			link, err := targetFSOrDisk(a.targets).Readlink(outFilePath)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil || link != target.Link {
+				conflicts = append(conflicts, outFilePath)
+			}
+			continue
+		}
+		content, err := targetFSOrDisk(a.targets).ReadFile(outFilePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", outFilePath, err)
+		}
+		if hashContent(content) != target.Hash {
+			conflicts = append(conflicts, outFilePath)
+		}
+	}
+	return conflicts, nil
+}
+
+func (a *App) manifestPath() string {
+	return filepath.Join(a.stateDirPath, manifestFileName)
+}
+
+// saveManifest saves the manifest in the state dir, if there is one.
+func (a *App) saveManifest() error {
+	if a.stateDirPath == "" {
+		return nil
+	}
+	return a.manifest.Save(a.manifestPath())
+}
+
+// Application tasks
+
+// LoadEntry reads the tags declared in entry.yml.
+func (a *App) LoadEntry() (map[string]string, error) {
+	buf, err := fs.ReadFile(a.dotfilesFS, a.entryPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", a.entryPath, err)
+	}
+	var props map[string]string
+	err = yaml.Unmarshal(buf, &props)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", a.entryPath, err)
+	}
+	for k, v := range props {
+		if v == "" {
+			props[k] = k
+		}
+	}
+	return props, nil
+}
+
+// Collect probes the paths.yml entries of every component directory whose
+// conditions the current tag map satisfies.
+func (a *App) Collect() (map[string]string, []TagRecord, error) {
+	collector := Collector{Tags: a.tagMap}
+	props := make(map[string]string)
+	var records []TagRecord
+	for _, component := range a.components {
+		confPath := filepath.Join(component.Path, "paths.yml")
+		buf, err := fs.ReadFile(component.FS, "paths.yml")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", confPath, err)
+		}
+		var pathsConf PathsConf
+		err = yaml.Unmarshal(buf, &pathsConf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse %s: %w", confPath, err)
+		}
+		subProps, subRecords, err := collector.CollectWithProvenance(pathsConf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("collect %s: %w", confPath, err)
+		}
+		for key, value := range subProps {
+			props[key] = value
+		}
+		for _, record := range subRecords {
+			record.Source = confPath
+			records = append(records, record)
+		}
+	}
+	return props, records, nil
+}
+
+// ComponentConf is the contents of a component.yml, the settings of its
+// component directory.
+type ComponentConf struct {
+	TagSyntax      TagSyntax `yaml:"tag_syntax"`
+	FrontMatter    bool      `yaml:"front_matter"`
+	TagExpressions bool      `yaml:"tag_expressions"`
+}
+
+// LoadComponents reads the component.yml of every component directory. Its
+// settings apply where the Component does not set them.
+func (a *App) LoadComponents() error {
+	for i, component := range a.components {
+		confPath := filepath.Join(component.Path, "component.yml")
+		var componentConf ComponentConf
+		buf, err := fs.ReadFile(component.FS, "component.yml")
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return fmt.Errorf("read %s: %w", confPath, err)
+		default:
+			err = yaml.Unmarshal(buf, &componentConf)
+			if err != nil {
+				return fmt.Errorf("parse %s: %w", confPath, err)
+			}
+		}
+		switch componentConf.TagSyntax {
+		case "":
+			componentConf.TagSyntax = TagSyntaxUnderscore
+		case TagSyntaxUnderscore, TagSyntaxAt, TagSyntaxBraces:
+		default:
+			return fmt.Errorf("%s: invalid tag_syntax %q (want underscore, at or braces)", confPath, componentConf.TagSyntax)
+		}
+		if component.TagSyntax == "" {
+			a.components[i].TagSyntax = componentConf.TagSyntax
+		}
+		if !component.FrontMatter {
+			a.components[i].FrontMatter = componentConf.FrontMatter
+		}
+		if !component.TagExpressions {
+			a.components[i].TagExpressions = componentConf.TagExpressions
+		}
+	}
+	return nil
+}
+
+// LoadTags also returns the when conditions of the implications, and for
+// each tag, the path of the tags.yml defining it.
+func (a *App) LoadTags() (map[string]map[string]string, map[string]map[string]Condition, map[string]string, error) {
+	propsDef := make(map[string]map[string]string)
+	conditions := make(map[string]map[string]Condition)
+	confPaths := make(map[string]string)
+	for _, component := range a.components {
+		confPath := filepath.Join(component.Path, "tags.yml")
+		buf, err := fs.ReadFile(component.FS, "tags.yml")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("read %s: %w", confPath, err)
+		}
+		var tagConfMap map[string]map[string]TagChild
+		err = yaml.Unmarshal(buf, &tagConfMap)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("parse %s: %w", confPath, err)
+		}
+		for tag, children := range tagConfMap {
+			values := make(map[string]string)
+			delete(conditions, tag)
+			for k, v := range children {
+				values[k] = v.Value
+				if v.Value == "" {
+					values[k] = k
+				}
+				if len(v.When) > 0 {
+					if conditions[tag] == nil {
+						conditions[tag] = make(map[string]Condition)
+					}
+					conditions[tag][k] = v.When
+				}
+			}
+			propsDef[tag] = values // overwrite
+			confPaths[tag] = confPath
+		}
+	}
+	return propsDef, conditions, confPaths, nil
+}
+
+// TagChild is a tag implied by another one in tags.yml: its value, or a
+// mapping with the value and a when condition on the tags, e.g.
+// {value: wayland, when: linux}.
+type TagChild struct {
+	Value string
+	When  Condition
+}
+
+func (c *TagChild) UnmarshalYAML(unmarshal func(any) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*c = TagChild{Value: value}
+		return nil
+	}
+	type plain TagChild
+	return unmarshal((*plain)(c))
+}
+
+// LoadRules reads and compiles the rules.yml of every component directory.
+func (a *App) LoadRules() (map[string]WeaverRule, error) {
+	ruleConfMap := make(map[string]WeaverRule)
+	for _, component := range a.components {
+		confPath := filepath.Join(component.Path, "rules.yml")
+		buf, err := fs.ReadFile(component.FS, "rules.yml")
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", confPath, err)
+		}
+		var rulesConf RulesConf
+		err = yaml.Unmarshal(buf, &rulesConf)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", confPath, err)
+		}
+		for k, v := range rulesConf {
+			if v.Dir != "" {
+				v.Dirs = append(v.Dirs, v.Dir)
+			}
+			for _, dir := range v.Dirs {
+				if strings.Contains(dir, "{{") {
+					continue
+				}
+				if _, err := componentDir(dir); err != nil {
+					return nil, fmt.Errorf("%s: rule %q: %w", confPath, k, err)
+				}
+			}
+			var mode *int = nil
+			if v.Mode != "" {
+				modeInt, err := strconv.ParseInt(v.Mode, 8, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%s: rule %q: invalid mode %q: %w", confPath, k, v.Mode, err)
+				}
+				if modeInt < 0 || modeInt > 0777 {
+					return nil, fmt.Errorf("invalid mode: %s", v.Mode)
+				}
+				modeValue := int(modeInt)
+				mode = &modeValue
+			}
+			pat, err := regexp.Compile(v.Pat)
+			if err != nil {
+				return nil, fmt.Errorf("rules.yml: rule %q: invalid pattern %q: %w", k, v.Pat, err)
+			}
+			switch v.LinkFallback {
+			case "", "error", "copy":
+			default:
+				return nil, fmt.Errorf("%s: rule %q: invalid link_fallback %q (want error or copy)", confPath, k, v.LinkFallback)
+			}
+			if v.Link && (v.Header != "" || v.Footer != "" || v.Separator != "") {
+				return nil, fmt.Errorf("%s: rule %q: header, footer and separator cannot be used with link", confPath, k)
+			}
+			banners := make(map[string]*template.Template)
+			for key, text := range map[string]string{"header": v.Header, "footer": v.Footer, "separator": v.Separator} {
+				if text == "" {
+					continue
+				}
+				banners[key], err = template.New(k + " " + key).Funcs(templateFuncs(nil)).Option("missingkey=zero").Parse(text)
+				if err != nil {
+					return nil, fmt.Errorf("%s: rule %q: invalid %s: %w", confPath, k, key, err)
+				}
+			}
+			ruleConfMap[k] = WeaverRule{
+				Directories:  v.Dirs,
+				Pattern:      pat,
+				Mode:         mode,
+				Link:         v.Link,
+				LinkFallback: v.LinkFallback,
+				Tree:         v.Tree,
+				Header:       banners["header"],
+				Footer:       banners["footer"],
+				Separator:    banners["separator"],
+				Comment:      v.Comment,
+				Strict:       v.Strict,
+			}
+		}
+	}
+	return ruleConfMap, nil
+}
+
+// Weave pairs every rule with the fragments it selects.
+func (a *App) Weave() ([]DotEntry, error) {
+	weaver := Weaver{Record: true}
+	dotEntries, err := weaver.Weave(a.components, a.tagMap, a.ruleConfMap)
+	if err != nil {
+		return nil, err
+	}
+	a.explanations = weaver.Explanations
+	return dotEntries, nil
+}
+
+// Explain returns the explanations of the candidate files named fragment,
+// given as a path, a name relative to a rule directory, or a basename.
+func (a *App) Explain(fragment string) []Explanation {
+	var explanations []Explanation
+	for _, explanation := range a.explanations {
+		source := explanation.Source
+		if source.Name == fragment || filepath.Base(source.Path) == fragment || source.Path == filepath.Clean(fragment) {
+			explanations = append(explanations, explanation)
+		}
+	}
+	return explanations
+}
+
+// Expand resolves the entry tags and the tags collected so far through the
+// tags.yml implications, whose conditions see the tag map of the last round.
+func (a *App) Expand() (map[string]string, map[string]string, []TagRecord, error) {
+	expander := Expander{Probed: a.collectedTags, Conditions: a.tagConditions, Tags: a.tagMap}
+	acceptedTags, rejectedTags, records := expander.ExpandWithProvenance(a.tagConf, a.entryTags)
+	for i := range records {
+		switch {
+		case records[i].Depth > 0:
+			records[i].Source = a.tagConfPaths[records[i].Parent]
+		case records[i].Tag == "default":
+			records[i].Source = builtinSource
+		default:
+			records[i].Source = a.entryPath
+		}
+	}
+	return acceptedTags, rejectedTags, records, nil
+}
+
+// Diff writes a unified diff of every target which Execute would change.
+func (a *App) Diff(w io.Writer) error {
+	generator := Generator{NormalizeJoin: !a.rawConcat, Targets: a.targets, Paths: a.paths, Partials: a.partials, Strict: a.strict}
+	for _, entry := range a.dotEntries {
+		if err := generator.Diff(w, entry, a.tagMap); err != nil {
+			return fmt.Errorf("diff %s: %w", entry.Path(), err)
+		}
+	}
+	return nil
+}
+
+// Generate writes every target and records it in the manifest. It refuses
+// to overwrite edited targets unless Force or KeepEdits is set.
+func (a *App) Generate() error {
+	conflicts, err := a.findConflicts()
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		switch {
+		case a.keepEdits:
+			for _, path := range conflicts {
+				savedPath, err := a.saveEditedTarget(path)
+				if err != nil {
+					return err
+				}
+				color.New(color.FgYellow).Fprintf(a.stdout(), "saved %s as %s\n", path, savedPath)
+			}
+		case a.force:
+			color.New(color.FgYellow).Fprintf(a.stdout(), "overwriting edited files: %s\n", strings.Join(conflicts, ", "))
+		default:
+			return &ConflictError{Paths: conflicts}
+		}
+	}
+
+	generator := Generator{
+		NormalizeJoin: !a.rawConcat,
+		Targets:       a.targets,
+		Paths:         a.paths,
+		Partials:      a.partials,
+		Strict:        a.strict,
+	}
+	if backup := a.backupRun(); backup != nil {
+		generator.Backup = backup
+	}
+	var committed []string
+	for _, entry := range a.dotEntries {
+		result, err := generator.Generate(entry, a.tagMap)
+		if err != nil {
+			err = &GenerateError{
+				Committed: committed,
+				Err:       fmt.Errorf("generate %s: %w", entry.Path(), err),
+			}
+			if len(committed) > 0 {
+				// keep track of what was written so far
+				if saveErr := a.saveManifest(); saveErr != nil {
+					return errors.Join(err, saveErr)
+				}
+			}
+			return err
+		}
+		if result.Link != "" {
+			result.Outcome.color().Fprintf(a.stdout(), "%s %s -> %s\n", result.Outcome, result.Path, result.Link)
+		} else {
+			result.Outcome.color().Fprintf(a.stdout(), "%s %s\n", result.Outcome, result.Path)
+		}
+		a.results = append(a.results, result)
+		if result.Outcome != OutcomeUnchanged {
+			committed = append(committed, result.Path)
+		}
+		sources := make([]string, 0, len(entry.Sources))
+		for _, source := range entry.Sources {
+			sources = append(sources, source.Path)
+		}
+		target := ManifestTarget{
+			Path:    result.Path,
+			Rule:    entry.Path(),
+			Hash:    result.Hash,
+			Link:    result.Link,
+			Sources: sources,
+		}
+		if result.Link == "" {
+			target.Mode = fmt.Sprintf("%04o", result.Mode)
+		}
+		a.manifest.Record(target)
+	}
+	if generator.Backup != nil && generator.Backup.ID != "" {
+		a.logf("backup: %s\n", generator.Backup.ID)
+	}
+	a.manifest.GeneratedAt = time.Now()
+	a.manifest.Tags = a.tagMap
+	return a.saveManifest()
+}
+
+// Collect
+
+// PathsConf is the contents of a paths.yml: for each tag, the probes to try.
+type PathsConf map[string][]CollectorEntry
+
+// Collector resolves tag values by probing the host.
+type Collector struct {
+	// Tags decide the entries with a When condition.
+	Tags map[string]string
+}
+
+// CollectorEntry is one probe: an executable, a file, a directory or an
+// environment variable. A probe with a When condition is only tried if the
+// tags satisfy it.
+type CollectorEntry struct {
+	Type string
+	Name string
+	Path string
+	When Condition
+}
+
+// Collect returns the values of the tags whose probes resolved.
+func (c *Collector) Collect(pathsConf PathsConf) (map[string]string, error) {
+	props, _, err := c.CollectWithProvenance(pathsConf)
+	return props, err
+}
+
+// CollectWithProvenance also returns a record for every entry which resolved,
+// in the order they were probed; later records override earlier ones.
+func (c *Collector) CollectWithProvenance(pathsConf PathsConf) (map[string]string, []TagRecord, error) {
+	props := make(map[string]string)
+	var records []TagRecord
+	var keys []string
+	for key := range pathsConf {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		for _, entry := range pathsConf[key] {
+			if !entry.When.Satisfied(c.Tags) {
+				continue
+			}
+			name := key
+			if entry.Name != "" {
+				name = entry.Name
+			}
+			if entry.Type == "exec" {
+				if fullPath, err := exec.LookPath(name); err == nil {
+					props[key] = fullPath
+					records = append(records, TagRecord{Tag: key, Value: fullPath, Via: "exec " + name})
+				}
+			} else if entry.Type == "file" || entry.Type == "dir" {
+				filePath, err := expandHome(entry.Path)
+				if err != nil {
+					return nil, nil, err
+				}
+				if ft, err := os.Stat(filePath); err == nil {
+					valid := true
+					if entry.Type == "file" {
+						valid = valid && !ft.IsDir()
+					}
+					if entry.Type == "dir" {
+						valid = valid && ft.IsDir()
+					}
+					if valid {
+						if fullPath, err := filepath.Abs(filePath); err == nil {
+							props[key] = fullPath
+							records = append(records, TagRecord{Tag: key, Value: fullPath, Via: entry.Type + " " + entry.Path})
+						}
+					}
+				}
+			} else if entry.Type == "env" {
+				env := os.Getenv(name)
+				if env != "" {
+					props[key] = env
+					records = append(records, TagRecord{Tag: key, Value: env, Via: "env " + name})
+				}
+			} else {
+				return nil, nil, fmt.Errorf("unknown env collector entry type: %s", entry.Type)
+			}
+		}
+	}
+	return props, records, nil
+}
+
+// Expand
+
+// Expander resolves tags through their implications.
+type Expander struct {
+	// Probed are the tags found by paths.yml. They imply their children like
+	// the entry tags, but any declaration of the same tag wins over them.
+	Probed map[string]string
+	// Conditions are the when of the implications, by tag and child. Tags
+	// decide them, so that the result does not depend on the walk order.
+	Conditions map[string]map[string]Condition
+	Tags       map[string]string
+}
+
+type tagItem struct {
+	Tag        string
+	Value      string
+	Depth      int
+	Negative   bool
+	Importance int
+	Parent     string
+	When       Condition
+	Probed     bool
+}
+
+func makeTagItem(rawTag string, value string, depth int) tagItem {
+	negative := false
+	importance := 0
+	tag := rawTag
+	for strings.HasPrefix(tag, "!") {
+		exclamationCount := 0
+		for _, c := range tag {
+			if c == '!' {
+				exclamationCount++
+			} else {
+				break
+			}
+		}
+		negative = exclamationCount%2 == 1
+		tag = rawTag[exclamationCount:]
+		importance = exclamationCount
+	}
+	return tagItem{
+		Tag:        tag,
+		Value:      value,
+		Depth:      depth,
+		Negative:   negative,
+		Importance: importance,
+	}
+}
+
+func (e *Expander) walk(tagConf map[string]map[string]string, entryTags map[string]string) []tagItem {
+	queue := list.New()
+	for k, v := range entryTags {
+		queue.PushBack(makeTagItem(k, v, 0))
+	}
+	for k, v := range e.Probed {
+		item := makeTagItem(k, v, 0)
+		item.Importance = -1
+		item.Probed = true
+		queue.PushBack(item)
+	}
+	seenTags := make(map[string]int)
+	tagItems := make([]tagItem, 0)
+
+	// breadth first search
+	for queue.Len() > 0 {
+		item := queue.Remove(queue.Front()).(tagItem)
+		tagItems = append(tagItems, item)
+
+		if depth, ok := seenTags[item.Tag]; ok {
+			if depth < item.Depth {
+				continue
+			}
+		}
+		seenTags[item.Tag] = item.Depth
+
+		if item.Negative {
+			continue
+		}
+
+		newTags := tagConf[item.Tag]
+		for newTag, v := range newTags {
+			when := e.Conditions[item.Tag][newTag]
+			if !when.Satisfied(e.Tags) {
+				continue
+			}
+			newItem := makeTagItem(newTag, v, item.Depth+1)
+			newItem.Parent = item.Tag
+			newItem.When = when
+			queue.PushBack(newItem)
+		}
+	}
+
+	// order by importance desc, depth (, tag, value)
+	slices.SortFunc(tagItems, func(a, b tagItem) int {
+		importance := cmp.Compare(b.Importance, a.Importance)
+		if importance != 0 {
+			return importance
+		}
+		depth := cmp.Compare(a.Depth, b.Depth)
+		if depth != 0 {
+			return depth
+		}
+		tag := cmp.Compare(a.Tag, b.Tag)
+		if tag != 0 {
+			return tag
+		}
+		value := cmp.Compare(a.Value, b.Value)
+		if value != 0 {
+			return value
+		}
+		return cmp.Compare(a.Parent, b.Parent)
+	})
+	return tagItems
+}
+
+// dedup keeps the first, i.e. winning, item of each tag.
+func dedupTagItems(tagItems []tagItem) []tagItem {
+	uniqTagItems := make([]tagItem, 0)
+	uniqTags := make(map[string]struct{})
+	for _, item := range tagItems {
+		if _, ok := uniqTags[item.Tag]; ok {
+			continue
+		}
+		uniqTags[item.Tag] = struct{}{}
+		uniqTagItems = append(uniqTagItems, item)
+	}
+
+	return uniqTagItems
+}
+
+// Expand returns the tags implied by entryTags, split into accepted and
+// rejected ones.
+func (e *Expander) Expand(tagConf map[string]map[string]string, entryTags map[string]string) (acceptedTags map[string]string, rejectedTags map[string]string) {
+	acceptedTags, rejectedTags, _ = e.ExpandWithProvenance(tagConf, entryTags)
+	return acceptedTags, rejectedTags
+}
+
+// ExpandWithProvenance also returns a record for every declaration met during
+// the walk, the winning one of each tag first. Source is left for the caller;
+// the probed tags have the records of the Collector.
+func (e *Expander) ExpandWithProvenance(tagConf map[string]map[string]string, entryTags map[string]string) (acceptedTags map[string]string, rejectedTags map[string]string, records []TagRecord) {
+	allTagItems := e.walk(tagConf, entryTags)
+	for _, item := range allTagItems {
+		if item.Probed {
+			continue
+		}
+		records = append(records, TagRecord{
+			Tag:        item.Tag,
+			Value:      item.Value,
+			Depth:      item.Depth,
+			Parent:     item.Parent,
+			When:       strings.Join(item.When, " "),
+			Negative:   item.Negative,
+			Importance: item.Importance,
+		})
+	}
+	tagItems := dedupTagItems(allTagItems)
+
+	acceptedTags = make(map[string]string)
+	rejectedTags = make(map[string]string)
+
+	for _, item := range tagItems {
+		if item.Negative {
+			rejectedTags[item.Tag] = item.Value
+		} else {
+			acceptedTags[item.Tag] = item.Value
+		}
+	}
+
+	return acceptedTags, rejectedTags, records
+}
+
+// Provenance
+
+const builtinSource = "built-in"
+
+// TagRecord is one declaration of a tag value: by entry.yml, a tags.yml
+// implication, a paths.yml probe or polkadot itself.
+type TagRecord struct {
+	Tag        string
+	Value      string
+	Source     string // file path, or "built-in"
+	Via        string // probe of a paths.yml entry, e.g. "exec emacs"
+	Parent     string // implying tag of a tags.yml entry
+	When       string // condition of a tags.yml entry, e.g. "linux -ssh"
+	Depth      int    // depth in the implication walk
+	Negative   bool
+	Importance int
+}
+
+func (r *TagRecord) String() string {
+	value := r.Value
+	if r.Negative {
+		value = "rejected"
+	}
+	var details []string
+	if r.Via != "" {
+		details = append(details, r.Via)
+	}
+	if r.Parent != "" {
+		details = append(details, fmt.Sprintf("implied by %s at depth %d", r.Parent, r.Depth))
+	}
+	if r.When != "" {
+		details = append(details, "when "+r.When)
+	}
+	if r.Importance > 0 {
+		details = append(details, fmt.Sprintf("importance %d", r.Importance))
+	}
+	if len(details) == 0 {
+		return fmt.Sprintf("%s (%s)", value, r.Source)
+	}
+	return fmt.Sprintf("%s (%s: %s)", value, r.Source, strings.Join(details, ", "))
+}
+
+// mergeTagRecords groups the records by tag, the winning one first. Expanded
+// tags override built-in ones, which override collected ones; among collected
+// records the last one wins.
+func mergeTagRecords(expandRecords []TagRecord, builtinRecords []TagRecord, collectRecords []TagRecord) map[string][]TagRecord {
+	provenance := make(map[string][]TagRecord)
+	for _, record := range expandRecords {
+		provenance[record.Tag] = append(provenance[record.Tag], record)
+	}
+	for _, record := range builtinRecords {
+		provenance[record.Tag] = append(provenance[record.Tag], record)
+	}
+	for i := len(collectRecords) - 1; i >= 0; i-- {
+		record := collectRecords[i]
+		provenance[record.Tag] = append(provenance[record.Tag], record)
+	}
+	return provenance
+}
+
+// Weave
+
+// RulesConf is the contents of a rules.yml, keyed by target.
+type RulesConf map[string]WeaverEntry
+
+// Weaver selects the fragments of every target.
+type Weaver struct {
+	// Record makes Walk keep an Explanation for every candidate file.
+	Record       bool
+	Explanations []Explanation
+}
+
+// WeaverEntry is a rule as written in rules.yml.
+type WeaverEntry struct {
+	Dir          string
+	Dirs         []string
+	Pat          string
+	Mode         string
+	Link         bool
+	LinkFallback string `yaml:"link_fallback"`
+	Tree         bool
+	Header       string
+	Footer       string
+	Separator    string
+	Comment      string
+	Strict       *bool
+}
+
+// WeaverRule is a parsed WeaverEntry.
+type WeaverRule struct {
+	Directories []string
+	Pattern     *regexp.Regexp
+	Mode        *int
+	// Link makes the target a symbolic link to its single source.
+	Link bool
+	// LinkFallback tells what to do when the target cannot be linked: "copy"
+	// generates it as usual, "error" (or empty) fails.
+	LinkFallback string
+	// Tree makes the target a directory, mirroring every selected file of
+	// the rule directories.
+	Tree bool
+	// Header, Footer and Separator, if set, are written before the first
+	// source, after the last one and before each one. See BannerData.
+	Header    *template.Template
+	Footer    *template.Template
+	Separator *template.Template
+	// Comment starts a comment line in the target, guessed from its
+	// extension if empty.
+	Comment string
+	// Strict, if set, overrides Generator.Strict for the rule.
+	Strict *bool
+}
+
+// DotSource is a fragment, with the tags encoded in its name.
+type DotSource struct {
+	Name string
+	Path string
+	Tags []string
+	// FS holds the fragment at FSPath. If nil, Path is read from the disk.
+	FS     fs.FS
+	FSPath string
+	// DiskPath is the fragment on the disk, if FS is a directory there.
+	DiskPath string
+	// FrontMatter is the front matter of the fragment, if any. Its tags are
+	// in Tags too.
+	FrontMatter *FrontMatter
+	// untaggedName is Name without its tags.
+	untaggedName string
+}
+
+// perm returns the permission bits of the fragment, 0 if its FS has none.
+func (s *DotSource) perm() (fs.FileMode, error) {
+	info, err := fs.Stat(s.FS, s.FSPath)
+	if err != nil {
+		return 0, fmt.Errorf("stat %s: %w", s.Path, err)
+	}
+	return info.Mode().Perm(), nil
+}
+
+// tagTerms parses the i-th of its Tags, from component. Those of its front
+// matter are always tag expressions, unlike those of its name.
+func (s *DotSource) tagTerms(component Component, i int) []tagTerm {
+	if s.FrontMatter != nil && i >= len(s.Tags)-len(s.FrontMatter.Tags) {
+		return tagTerms(s.Tags[i])
+	}
+	return component.tagTerms(s.Tags[i])
+}
+
+// ReadFile returns the contents of the fragment.
+func (s *DotSource) ReadFile() ([]byte, error) {
+	var content []byte
+	var err error
+	if s.FS == nil {
+		content, err = os.ReadFile(s.Path)
+	} else {
+		content, err = fs.ReadFile(s.FS, s.FSPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", s.Path, err)
+	}
+	if s.FrontMatter != nil {
+		_, content, err = splitFrontMatter(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.Path, err)
+		}
+	}
+	return content, nil
+}
+
+// IsTemplate tells whether the fragment is rendered as a template: it is
+// tagged gtp, or its front matter says so.
+func (s *DotSource) IsTemplate() bool {
+	return stringInSlice("gtp", s.Tags) || (s.FrontMatter != nil && s.FrontMatter.Template)
+}
+
+// priority returns the priority of the front matter, 0 if none.
+func (s *DotSource) priority() int {
+	if s.FrontMatter == nil {
+		return 0
+	}
+	return s.FrontMatter.Priority
+}
+
+// DotTarget is a file to generate, as written in rules.yml.
+type DotTarget struct {
+	Path         string
+	Mode         *int
+	Link         bool
+	LinkFallback string
+	// Tree is set for the files of a tree rule, which are copied as they are
+	// instead of being normalized.
+	Tree      bool
+	Header    *template.Template
+	Footer    *template.Template
+	Separator *template.Template
+	Comment   string
+	Strict    *bool
+}
+
+// DotEntry is a target and its sources in concatenation order.
+type DotEntry struct {
+	Sources []DotSource
+	Target  DotTarget
+}
+
+// Path returns the target path as written in rules.yml.
+func (e *DotEntry) Path() string {
+	return e.Target.Path
+}
+
+// Weave returns the entries of every rule, sorted by target. Target paths
+// and directories are first rendered against tagMap, see renderRulePath.
+func (w *Weaver) Weave(components []Component, tagMap map[string]string, ruleConfMap map[string]WeaverRule) ([]DotEntry, error) {
+	sourcesMap := make(map[string][]DotSource)
+	targetMap := make(map[string]DotTarget)
+	ruleOfTarget := make(map[string]string)
+	addTarget := func(rule string, target DotTarget, sources []DotSource) error {
+		if other, ok := ruleOfTarget[target.Path]; ok {
+			rules := []string{other, rule}
+			slices.Sort(rules)
+			return fmt.Errorf("%s is generated by both rule %q and rule %q", target.Path, rules[0], rules[1])
+		}
+		ruleOfTarget[target.Path] = rule
+		sourcesMap[target.Path] = sources
+		targetMap[target.Path] = target
+		return nil
+	}
+	for rule, ruleConf := range ruleConfMap {
+		outFile, err := renderRulePath(rule, tagMap)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule, err)
+		}
+		if outFile == "" {
+			continue
+		}
+		sourceArrayMap := make(map[string][]DotSource)
+		for _, dirTemplate := range ruleConf.Directories {
+			dir, err := renderRulePath(dirTemplate, tagMap)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q: %w", rule, err)
+			}
+			if dir == "" {
+				continue
+			}
+			for _, component := range components {
+				recorded := len(w.Explanations)
+				sourceMap, err := w.Walk(component, dir, tagMap, ruleConf)
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", rule, err)
+				}
+				for i := recorded; i < len(w.Explanations); i++ {
+					w.Explanations[i].Target = outFile
+				}
+				for name, source := range sourceMap {
+					_, ok := sourceArrayMap[name]
+					if !ok {
+						sourceArrayMap[name] = make([]DotSource, 0)
+					}
+					sourceArrayMap[name] = append(sourceArrayMap[name], source)
+				}
+			}
+		}
+		target := DotTarget{
+			Path:         outFile,
+			Mode:         ruleConf.Mode,
+			Link:         ruleConf.Link,
+			LinkFallback: ruleConf.LinkFallback,
+			Tree:         ruleConf.Tree,
+			Header:       ruleConf.Header,
+			Footer:       ruleConf.Footer,
+			Separator:    ruleConf.Separator,
+			Comment:      ruleConf.Comment,
+			Strict:       ruleConf.Strict,
+		}
+		if !ruleConf.Tree {
+			if err := addTarget(rule, target, mergeSourceArrayMap(sourceArrayMap)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sources, err := treeSources(sourceArrayMap)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule, err)
+		}
+		for name, source := range sources {
+			target.Path = strings.TrimSuffix(outFile, "/") + "/" + filepath.ToSlash(name)
+			// a mirrored file keeps the mode of its source, e.g. 0755 for a
+			// script, unless the rule sets one
+			target.Mode = ruleConf.Mode
+			if target.Mode == nil {
+				perm, err := source.perm()
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: %w", rule, err)
+				}
+				if perm != 0 {
+					mode := int(perm)
+					target.Mode = &mode
+				}
+			}
+			if err := addTarget(rule, target, []DotSource{source}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	slices.SortStableFunc(w.Explanations, func(a, b Explanation) int {
+		return cmp.Compare(a.Target, b.Target)
+	})
+	dotEntries := dotMapsToEntries(sourcesMap, targetMap)
+	return dotEntries, nil
+}
+
+// componentDir returns dir, relative to the root of a component, as a path
+// of its FS. It fails if dir is outside the component, e.g. ../shared.
+func componentDir(dir string) (string, error) {
+	root := path.Clean(strings.TrimPrefix(dir, "/"))
+	if !fs.ValidPath(root) {
+		return "", fmt.Errorf("dir %q is outside the component", dir)
+	}
+	return root, nil
+}
+
+// Walk returns the files under dir in component selected by ruleConf, keyed
+// by their path relative to dir.
+func (w *Weaver) Walk(component Component, dir string, tagMap map[string]string, ruleConf WeaverRule) (map[string]DotSource, error) {
+	sourceMap := make(map[string]DotSource)
+	root, err := componentDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.WalkDir(
+		component.FS,
+		root,
+		func(fsPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			name := fsPath
+			if root != "." {
+				name = strings.TrimPrefix(fsPath, root+"/")
+			}
+			explanation := Explanation{
+				Source: DotSource{
+					Name:         name,
+					Path:         filepath.Join(component.Path, filepath.FromSlash(fsPath)),
+					Tags:         extractTagsFromPath(name, component.TagSyntax, ruleConf.Tree),
+					FS:           component.FS,
+					FSPath:       fsPath,
+					untaggedName: untaggedPath(name, component.TagSyntax),
+				},
+				Pattern:        ruleConf.Pattern.String(),
+				PatternMatched: ruleConf.Pattern.MatchString(name),
+			}
+			if component.Dir != "" {
+				explanation.Source.DiskPath = filepath.Join(component.Dir, filepath.FromSlash(fsPath))
+			}
+			if explanation.PatternMatched && component.FrontMatter {
+				content, err := fs.ReadFile(component.FS, fsPath)
+				if err != nil {
+					return fmt.Errorf("read %s: %w", explanation.Source.Path, err)
+				}
+				frontMatter, _, err := splitFrontMatter(content)
+				if err != nil {
+					return fmt.Errorf("%s: %w", explanation.Source.Path, err)
+				}
+				if frontMatter != nil {
+					explanation.Source.FrontMatter = frontMatter
+					explanation.Source.Tags = append(explanation.Source.Tags, frontMatter.Tags...)
+				}
+			}
+			if explanation.PatternMatched {
+				for i, tag := range explanation.Source.Tags {
+					if !termsSatisfied(explanation.Source.tagTerms(component, i), tagMap) {
+						explanation.MissingTags = append(explanation.MissingTags, tag)
+					}
+				}
+			}
+			if w.Record {
+				w.Explanations = append(w.Explanations, explanation)
+			}
+			if explanation.Included() {
+				sourceMap[name] = explanation.Source
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, fmt.Errorf("walk %s: %w", filepath.Join(component.Path, filepath.FromSlash(root)), err)
+	}
+	return sourceMap, nil
+}
+
+// Explanation tells why a candidate file is or is not a source of a target.
+// MissingTags, the tags of the name which tagMap does not satisfy (see
+// tagSatisfied), is only filled when the pattern matched.
+type Explanation struct {
+	Target         string
+	Source         DotSource
+	Pattern        string
+	PatternMatched bool
+	MissingTags    []string
+}
+
+// Included reports whether the file is a source of the target.
+func (e *Explanation) Included() bool {
+	return e.PatternMatched && len(e.MissingTags) == 0
+}
+
+// Reason describes why the file is included or excluded.
+func (e *Explanation) Reason() string {
+	switch {
+	case !e.PatternMatched:
+		return fmt.Sprintf("excluded: %q does not match pattern %q", e.Source.Name, e.Pattern)
+	case len(e.MissingTags) > 0:
+		return "excluded: missing tags: " + strings.Join(e.MissingTags, ", ")
+	}
+	return "included"
+}
+
+func removeDuplicatedDotSource(sources []DotSource) []DotSource {
+	set := make(map[string]struct{})
+	list := make([]DotSource, 0)
+	for _, source := range sources {
+		if _, ok := set[source.Path]; !ok {
+			set[source.Path] = struct{}{}
+			list = append(list, source)
+		}
+	}
+	return list
+}
+
+func mergeSourceArrayMap(sourceArrayMap map[string][]DotSource) (sources []DotSource) {
+	var names []string
+	for name := range sourceArrayMap {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		sourceArray := sourceArrayMap[name]
+		sources = append(sources, sourceArray...)
+	}
+	sources = removeDuplicatedDotSource(sources)
+	slices.SortStableFunc(sources, func(a, b DotSource) int {
+		return cmp.Compare(a.priority(), b.priority())
+	})
+	return
+}
+
+// treeSources maps the output names of a tree rule, relative to its target
+// directory, to their sources. A source of a later directory overrides one of
+// the same name in an earlier one. Two selected names with the same output
+// name, e.g. a_linux.conf and a_work.conf, are an error.
+func treeSources(sourceArrayMap map[string][]DotSource) (map[string]DotSource, error) {
+	var names []string
+	for name := range sourceArrayMap {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	sources := make(map[string]DotSource)
+	nameOfOutput := make(map[string]string)
+	for _, name := range names {
+		sourceArray := sourceArrayMap[name]
+		source := sourceArray[len(sourceArray)-1]
+		output := source.untaggedName
+		if other, ok := nameOfOutput[output]; ok {
+			return nil, fmt.Errorf("%s and %s both generate %s", other, name, output)
+		}
+		nameOfOutput[output] = name
+		sources[output] = source
+	}
+	return sources, nil
+}
+
+// Stabilizes the order of dot entries.
+func dotMapsToEntries(sourcesMap map[string][]DotSource, targetMap map[string]DotTarget) []DotEntry {
+	entries := make([]DotEntry, 0, len(sourcesMap))
+	for outFilePath, sources := range sourcesMap {
+		target := targetMap[outFilePath]
+		entry := DotEntry{Sources: sources, Target: target}
+		entries = append(entries, entry)
+	}
+	slices.SortFunc(entries, func(a, b DotEntry) int {
+		return cmp.Compare(a.Path(), b.Path())
+	})
+	return entries
+}
+
+// Generate
+
+var excessNewlines = regexp.MustCompile(`\n{3,}`)
+
+// Generator renders and writes targets.
+type Generator struct {
+	NormalizeJoin bool
+	// Targets reads and writes the targets, the disk if nil.
+	Targets TargetFS
+	// Paths maps the target paths to the files written.
+	Paths TargetPaths
+	// Backup, if set, saves each target before it is overwritten.
+	Backup *BackupRun
+	// Partials, if set, can be called from gtp fragments, see LoadPartials.
+	Partials *template.Template
+	// Strict makes a gtp fragment fail on a missing tag instead of rendering
+	// it empty, unless the rule of the target says otherwise.
+	Strict bool
+}
+
+func (g *Generator) appendDotGtp(w io.Writer, source DotSource, tagMap map[string]string, strict bool) error {
+	content, err := source.ReadFile()
+	if err != nil {
+		return err
+	}
+	tpl, err := newTemplate(filepath.Base(source.Path), g.Partials, tagMap)
+	if err != nil {
+		return err
+	}
+	lineOffset := 0
+	if source.FrontMatter != nil {
+		lineOffset = source.FrontMatter.lines
+		if delims := source.FrontMatter.Delims; len(delims) == 2 {
+			tpl = tpl.Delims(delims[0], delims[1])
+		}
+	}
+	tpl, err = tpl.Parse(string(content))
+	if err != nil {
+		return fmt.Errorf("parse template %s: %w", source.Path, err)
+	}
+	if strict {
+		tpl = tpl.Option("missingkey=error")
+	} else {
+		tpl = tpl.Option("missingkey=zero")
+	}
+	if err := tpl.Execute(w, tagMap); err != nil {
+		if missing := asMissingTagError(err, tpl.Name(), source.Path); missing != nil {
+			if missing.Path == source.Path {
+				missing.Line += lineOffset
+			}
+			return missing
+		}
+		return fmt.Errorf("execute template %s: %w", source.Path, err)
+	}
+	return nil
+}
+
+func (g *Generator) appendDotText(w io.Writer, source DotSource, tagMap map[string]string) error {
+	content, err := source.ReadFile()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return fmt.Errorf("copy %s: %w", source.Path, err)
+	}
+	return nil
+}
+
+func (g *Generator) appendDot(w io.Writer, source DotSource, tagMap map[string]string, strict bool) error {
+	var err error = nil
+	if source.IsTemplate() {
+		err = g.appendDotGtp(w, source, tagMap, strict)
+	} else {
+		err = g.appendDotText(w, source, tagMap)
+	}
+	return err
+}
+
+// BannerData is the data of the header, footer and separator templates of a
+// rule.
+type BannerData struct {
+	// Target is the target path, as written in rules.yml.
+	Target string
+	// Comment starts a comment line in the target, e.g. "#" or "--".
+	Comment string
+	Tags    map[string]string
+	Sources []DotSource
+	// Source is the source following a separator, and Index its position in
+	// Sources.
+	Source DotSource
+	Index  int
+}
+
+// commentPrefixes maps the extension of a target to the start of its comment
+// lines, for the targets whose comments do not start with #.
+var commentPrefixes = map[string]string{
+	".lua": "--",
+	".sql": "--",
+	".hs":  "--",
+	".vim": "\"",
+	".el":  ";;",
+	".ini": ";",
+	".c":   "//",
+	".h":   "//",
+	".go":  "//",
+	".js":  "//",
+	".ts":  "//",
+	".rs":  "//",
+	".tex": "%",
+	".erl": "%",
+}
+
+// comment returns Comment, or the comment syntax of the extension of Path.
+func (t DotTarget) comment() string {
+	if t.Comment != "" {
+		return t.Comment
+	}
+	base := path.Base(t.Path)
+	if strings.HasSuffix(base, "vimrc") {
+		return "\""
+	}
+	if prefix, ok := commentPrefixes[path.Ext(base)]; ok {
+		return prefix
+	}
+	return "#"
+}
+
+// writeBanner executes tpl, if set, ending its output with a newline.
+func writeBanner(w io.Writer, tpl *template.Template, data BannerData) error {
+	if tpl == nil {
+		return nil
+	}
+	tpl, err := tpl.Clone()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Funcs(templateFuncs(data.Tags)).Execute(&buf, data); err != nil {
+		return fmt.Errorf("execute %s: %w", tpl.Name(), err)
+	}
+	if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (g *Generator) concatDots(w io.Writer, target DotTarget, sources []DotSource, tagMap map[string]string, normalize bool) error {
+	strict := g.Strict
+	if target.Strict != nil {
+		strict = *target.Strict
+	}
+	data := BannerData{Target: target.Path, Comment: target.comment(), Tags: tagMap, Sources: sources}
+	if err := writeBanner(w, target.Header, data); err != nil {
+		return err
+	}
+	for i, source := range sources {
+		data.Source, data.Index = source, i
+		if err := writeBanner(w, target.Separator, data); err != nil {
+			return err
+		}
+		if !normalize {
+			if err := g.appendDot(w, source, tagMap, strict); err != nil {
+				return err
+			}
+			continue
+		}
+		var buf bytes.Buffer
+		if err := g.appendDot(&buf, source, tagMap, strict); err != nil {
+			return err
+		}
+		content := bytes.TrimRight(buf.Bytes(), "\n")
+		if _, err := w.Write(content); err != nil {
+			return err
+		}
+		sep := "\n\n"
+		if i == len(sources)-1 {
+			sep = "\n"
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+	}
+	data.Source, data.Index = DotSource{}, 0
+	return writeBanner(w, target.Footer, data)
+}
+
+// Render concatenates the sources of dotEntry into memory.
+func (g *Generator) Render(dotEntry DotEntry, tagMap map[string]string) ([]byte, error) {
+	var buf bytes.Buffer
+	normalize := g.NormalizeJoin && !dotEntry.Target.Tree
+	if err := g.concatDots(&buf, dotEntry.Target, dotEntry.Sources, tagMap, normalize); err != nil {
+		return nil, err
+	}
+	content := buf.Bytes()
+	if normalize {
+		content = excessNewlines.ReplaceAll(content, []byte("\n\n"))
+	}
+	return content, nil
+}
+
+// targetMode returns the mode the target will have after generation. An
+// existing file keeps its mode unless the rule specifies one.
+func targetMode(dotEntry DotEntry, info os.FileInfo) os.FileMode {
+	if dotEntry.Target.Mode != nil {
+		return os.FileMode(*dotEntry.Target.Mode)
+	}
+	if info != nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// Diff writes a unified diff between the existing target and the content
+// Generate would write. It writes nothing when the target is up to date.
+func (g *Generator) Diff(w io.Writer, dotEntry DotEntry, tagMap map[string]string) error {
+	outFilePath, err := g.Paths.Resolve(dotEntry.Path())
+	if err != nil {
+		return err
+	}
+	linkPath, err := g.linkPath(dotEntry)
+	if err != nil {
+		return err
+	}
+	if linkPath != "" {
+		return g.diffLink(w, outFilePath, linkPath)
+	}
+	content, err := g.Render(dotEntry, tagMap)
+	if err != nil {
+		return err
+	}
+
+	targets := targetFSOrDisk(g.Targets)
+	info, err := targets.Lstat(outFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("stat %s: %w", outFilePath, err)
+	}
+	bold := color.New(color.Bold)
+	if info != nil && info.Mode()&fs.ModeSymlink != 0 {
+		if _, err := bold.Fprintf(w, "replace link %s with a file (mode: %04o)\n", outFilePath, targetMode(dotEntry, nil)); err != nil {
+			return err
+		}
+		return writeUnifiedDiff(w, "/dev/null", outFilePath, nil, content)
+	}
+	var oldContent []byte
+	if info != nil {
+		oldContent, err = targets.ReadFile(outFilePath)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", outFilePath, err)
+		}
+	}
+	mode := targetMode(dotEntry, info)
+
+	if info == nil {
+		if _, err := bold.Fprintf(w, "new file %s (mode: %04o)\n", outFilePath, mode); err != nil {
+			return err
+		}
+		return writeUnifiedDiff(w, "/dev/null", outFilePath, nil, content)
+	}
+	if info.Mode().Perm() != mode {
+		if _, err := bold.Fprintf(w, "mode change %s (%04o => %04o)\n", outFilePath, info.Mode().Perm(), mode); err != nil {
+			return err
+		}
+	}
+	return writeUnifiedDiff(w, outFilePath, outFilePath, oldContent, content)
+}
+
+// diffLink describes how a link target would change.
+func (g *Generator) diffLink(w io.Writer, outFilePath string, linkPath string) error {
+	targets := targetFSOrDisk(g.Targets)
+	info, err := targets.Lstat(outFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("stat %s: %w", outFilePath, err)
+	}
+	bold := color.New(color.Bold)
+	switch {
+	case info == nil:
+		_, err = bold.Fprintf(w, "new link %s -> %s\n", outFilePath, linkPath)
+	case info.Mode()&fs.ModeSymlink == 0:
+		_, err = bold.Fprintf(w, "replace file %s with a link to %s\n", outFilePath, linkPath)
+	default:
+		oldLinkPath, err := targets.Readlink(outFilePath)
+		if err != nil {
+			return fmt.Errorf("readlink %s: %w", outFilePath, err)
+		}
+		if oldLinkPath == linkPath {
+			return nil
+		}
+		_, err = bold.Fprintf(w, "relink %s (%s => %s)\n", outFilePath, oldLinkPath, linkPath)
+		return err
+	}
+	return err
+}
+
+// linkPath returns the absolute path of the source the target of dotEntry
+// links to, or an empty path if it is generated as a file. It fails if the
+// target should be a link but cannot be, unless the rule falls back to copy.
+func (g *Generator) linkPath(dotEntry DotEntry) (string, error) {
+	if !dotEntry.Target.Link {
+		return "", nil
+	}
+	var reason string
+	switch {
+	case len(dotEntry.Sources) != 1:
+		reason = fmt.Sprintf("it has %d sources", len(dotEntry.Sources))
+	case dotEntry.Sources[0].IsTemplate():
+		reason = dotEntry.Sources[0].Path + " is a template"
+	case dotEntry.Sources[0].FrontMatter != nil:
+		reason = dotEntry.Sources[0].Path + " has a front matter"
+	case dotEntry.Sources[0].FS != nil && dotEntry.Sources[0].DiskPath == "":
+		reason = dotEntry.Sources[0].Path + " is not on the disk"
+	}
+	if reason != "" {
+		if dotEntry.Target.LinkFallback == "copy" {
+			return "", nil
+		}
+		return "", fmt.Errorf("cannot link %s: %s", dotEntry.Path(), reason)
+	}
+	source := dotEntry.Sources[0]
+	diskPath := source.DiskPath
+	if source.FS == nil {
+		diskPath = source.Path
+	}
+	linkPath, err := filepath.Abs(diskPath)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", diskPath, err)
+	}
+	return linkPath, nil
+}
+
+// Outcome tells what Generator.Generate did to a target.
+type Outcome int
+
+const (
+	OutcomeCreated Outcome = iota
+	OutcomeUpdated
+	OutcomeUnchanged
+	OutcomeModeChanged
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeCreated:
+		return "created"
+	case OutcomeUpdated:
+		return "updated"
+	case OutcomeUnchanged:
+		return "unchanged"
+	case OutcomeModeChanged:
+		return "mode changed"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+func (o Outcome) MarshalText() ([]byte, error) {
+	return []byte(o.String()), nil
+}
+
+func (o Outcome) color() *color.Color {
+	switch o {
+	case OutcomeCreated:
+		return color.New(color.FgGreen)
+	case OutcomeUpdated:
+		return color.New(color.FgYellow)
+	case OutcomeModeChanged:
+		return color.New(color.FgMagenta)
+	}
+	return color.New(color.Faint)
+}
+
+// GenerateResult describes a target handled by Generator.Generate.
+type GenerateResult struct {
+	Path    string // with ~/ expanded
+	Mode    os.FileMode
+	Hash    string
+	Link    string // the source a link target points to; Mode and Hash are unset
+	Outcome Outcome
+}
+
+// Generate writes the target of dotEntry unless it is up to date.
+func (g *Generator) Generate(dotEntry DotEntry, tagMap map[string]string) (GenerateResult, error) {
+	// expand ~/
+	outFilePath, err := g.Paths.Resolve(dotEntry.Path())
+	if err != nil {
+		return GenerateResult{}, err
+	}
+
+	linkPath, err := g.linkPath(dotEntry)
+	if err != nil {
+		return GenerateResult{}, err
+	}
+	if linkPath != "" {
+		return g.generateLink(outFilePath, linkPath)
+	}
+
+	content, err := g.Render(dotEntry, tagMap)
+	if err != nil {
+		return GenerateResult{}, err
+	}
+
+	targets := targetFSOrDisk(g.Targets)
+	info, err := targets.Lstat(outFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return GenerateResult{}, fmt.Errorf("stat %s: %w", outFilePath, err)
+	}
+	replacesLink := info != nil && info.Mode()&fs.ModeSymlink != 0
+	if replacesLink {
+		// the file replacing the link gets the mode of a new file
+		info = nil
+	}
+	mode := targetMode(dotEntry, info)
+	result := GenerateResult{
+		Path:    outFilePath,
+		Mode:    mode,
+		Hash:    hashContent(content),
+		Outcome: OutcomeCreated,
+	}
+	if replacesLink {
+		result.Outcome = OutcomeUpdated
+	}
+	if info != nil {
+		oldContent, err := targets.ReadFile(outFilePath)
+		if err != nil {
+			return GenerateResult{}, fmt.Errorf("read %s: %w", outFilePath, err)
+		}
+		switch {
+		case !bytes.Equal(oldContent, content):
+			result.Outcome = OutcomeUpdated
+		case info.Mode().Perm() != mode:
+			result.Outcome = OutcomeModeChanged
+		default:
+			result.Outcome = OutcomeUnchanged
+			return result, nil
+		}
+	}
+
+	if g.Backup != nil {
+		if err := g.Backup.Save(outFilePath); err != nil {
+			return GenerateResult{}, fmt.Errorf("backup %s: %w", outFilePath, err)
+		}
+	}
+
+	if result.Outcome == OutcomeModeChanged {
+		if err := targets.Chmod(outFilePath, mode); err != nil {
+			return GenerateResult{}, fmt.Errorf("chmod %s: %w", outFilePath, err)
+		}
+		return result, nil
+	}
+	if err := targets.WriteFile(outFilePath, content, mode); err != nil {
+		return GenerateResult{}, err
+	}
+	return result, nil
+}
+
+// generateLink makes outFilePath a symbolic link to linkPath unless it
+// already is one.
+func (g *Generator) generateLink(outFilePath string, linkPath string) (GenerateResult, error) {
+	targets := targetFSOrDisk(g.Targets)
+	info, err := targets.Lstat(outFilePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return GenerateResult{}, fmt.Errorf("stat %s: %w", outFilePath, err)
+	}
+	result := GenerateResult{
+		Path:    outFilePath,
+		Link:    linkPath,
+		Outcome: OutcomeCreated,
+	}
+	if info != nil {
+		result.Outcome = OutcomeUpdated
+		if info.Mode()&fs.ModeSymlink != 0 {
+			oldLinkPath, err := targets.Readlink(outFilePath)
+			if err != nil {
+				return GenerateResult{}, fmt.Errorf("readlink %s: %w", outFilePath, err)
+			}
+			if oldLinkPath == linkPath {
+				result.Outcome = OutcomeUnchanged
+				return result, nil
+			}
+		}
+	}
+
+	if g.Backup != nil {
+		if err := g.Backup.Save(outFilePath); err != nil {
+			return GenerateResult{}, fmt.Errorf("backup %s: %w", outFilePath, err)
+		}
+	}
+	if err := targets.Symlink(linkPath, outFilePath); err != nil {
+		return GenerateResult{}, err
+	}
+	return result, nil
+}
+
+// GenerateError is returned when an entry fails to be generated. Committed
+// lists the targets which had already been written.
+type GenerateError struct {
+	Committed []string
+	Err       error
+}
+
+func (e *GenerateError) Error() string {
+	if len(e.Committed) == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%v\ncommitted before the failure:\n- %s", e.Err, strings.Join(e.Committed, "\n- "))
+}
+
+func (e *GenerateError) Unwrap() error {
+	return e.Err
+}
+
+// Conflict
+
+// ConflictError is returned when targets were edited after polkadot last
+// generated them.
+type ConflictError struct {
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("edited since last generated (use -force to overwrite or -keep-edits to save them aside):\n- %s",
+		strings.Join(e.Paths, "\n- "))
+}
+
+// saveEditedTarget copies an edited target into the state directory, under
+// edited/<run-id>/ and its own path, and returns the path of the copy. The
+// run is the one backing up the target before it is overwritten. Without a
+// state directory, the copy is put next to the target.
+func (a *App) saveEditedTarget(path string) (string, error) {
+	targets := targetFSOrDisk(a.targets)
+	info, err := targets.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("stat %s: %w", path, err)
+	}
+	content, err := targets.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", path, err)
+	}
+	backup := a.backupRun()
+	if backup == nil {
+		savedPath := fmt.Sprintf("%s.edited-%s", path, time.Now().Format("20060102-150405"))
+		if err := targets.WriteFile(savedPath, content, info.Mode().Perm()); err != nil {
+			return "", fmt.Errorf("write %s: %w", savedPath, err)
+		}
+		return savedPath, nil
+	}
+	if err := backup.init(); err != nil {
+		return "", err
+	}
+	savedPath := filepath.Join(a.stateDirPath, editedDirName, backup.ID, path)
+	if err := os.MkdirAll(filepath.Dir(savedPath), 0700); err != nil {
+		return "", fmt.Errorf("mkdir %s: %w", filepath.Dir(savedPath), err)
+	}
+	if err := os.WriteFile(savedPath, content, info.Mode().Perm()); err != nil {
+		return "", fmt.Errorf("write %s: %w", savedPath, err)
+	}
+	return savedPath, nil
+}
+
+// Prune
+
+// pruneTarget removes a previously generated target unless it was modified
+// after generation, saving it in backup first if set. It reports whether the
+// target is gone.
+func pruneTarget(w io.Writer, targets TargetFS, backup *BackupRun, target ManifestTarget) (bool, error) {
+	var modified bool
+	if target.Link != "" {
+		link, err := targets.Readlink(target.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			color.New(color.Faint).Fprintf(w, "already removed %s\n", target.Path)
+			return true, nil
+		}
+		modified = err != nil || link != target.Link
+	} else {
+		content, err := targets.ReadFile(target.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			color.New(color.Faint).Fprintf(w, "already removed %s\n", target.Path)
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("read %s: %w", target.Path, err)
+		}
+		modified = hashContent(content) != target.Hash
+	}
+	if modified {
+		color.New(color.FgYellow).Fprintf(w, "skip %s (modified since generated)\n", target.Path)
+		return false, nil
+	}
+	if backup != nil {
+		if err := backup.Save(target.Path); err != nil {
+			return false, fmt.Errorf("backup %s: %w", target.Path, err)
+		}
+	}
+	if err := targets.Remove(target.Path); err != nil {
+		return false, fmt.Errorf("remove %s: %w", target.Path, err)
+	}
+	color.New(color.FgRed).Fprintf(w, "removed %s\n", target.Path)
+	return true, nil
+}
+
+// Utils
+
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("expand home: %w", err)
+	}
+	return filepath.Join(home, path[2:]), nil
+}
+
+func toBasenameWithoutExt(path string, recursive bool) (basename string) {
+	basename = filepath.Base(path)
+	oldlen := len(basename)
+	for {
+		basename = strings.TrimSuffix(basename, filepath.Ext(basename))
+		if oldlen <= len(basename) || !recursive {
+			break
+		}
+		oldlen = len(basename)
+	}
+	return
+}
+
+// TagSyntax is how the fragment names of a component encode their tags.
+type TagSyntax string
+
+const (
+	// TagSyntaxUnderscore is name_tag1_tag2.ext, the default.
+	TagSyntaxUnderscore TagSyntax = "underscore"
+	// TagSyntaxAt is name@tag1@tag2.ext.
+	TagSyntaxAt TagSyntax = "at"
+	// TagSyntaxBraces is name.{tag1,tag2}.ext.
+	TagSyntaxBraces TagSyntax = "braces"
+)
+
+// split splits the basename of a fragment into its name, its tags and its
+// extensions, see splitTaggedName and splitBracedName.
+func (s TagSyntax) split(base string) (name string, tags []string, ext string) {
+	switch s {
+	case TagSyntaxAt:
+		return splitTaggedName(base, "@")
+	case TagSyntaxBraces:
+		return splitBracedName(base)
+	}
+	return splitTaggedName(base, "_")
+}
+
+// splitTaggedName splits the basename of a fragment, whose tags follow its
+// name after sep, into its name, its tags and its extensions:
+// .gitconfig_work_gtp.ini gives .gitconfig, [work gtp] and .ini. Leading dots
+// belong to the name, and tags end at the first dot after them.
+func splitTaggedName(base string, sep string) (name string, tags []string, ext string) {
+	rest := strings.TrimLeft(base, ".")
+	dots := base[:len(base)-len(rest)]
+	stem := toBasenameWithoutExt(rest, true)
+	ext = rest[len(stem):]
+	parts := strings.Split(stem, sep)
+	return dots + parts[0], parts[1:], ext
+}
+
+// splitBracedName splits the basename of a fragment whose tags are a
+// dot-separated {tag1,tag2} part: bashrc.{linux,gtp}.sh gives bashrc,
+// [linux gtp] and .sh. Without such a part, the name is the basename without
+// its extensions.
+func splitBracedName(base string) (name string, tags []string, ext string) {
+	rest := strings.TrimLeft(base, ".")
+	dots := base[:len(base)-len(rest)]
+	parts := strings.Split(rest, ".")
+	tags = []string{}
+	for i, part := range parts {
+		if i == 0 || !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			continue
+		}
+		if inner := part[1 : len(part)-1]; inner != "" {
+			tags = strings.Split(inner, ",")
+		}
+		if i+1 < len(parts) {
+			ext = "." + strings.Join(parts[i+1:], ".")
+		}
+		return dots + strings.Join(parts[:i], "."), tags, ext
+	}
+	stem := toBasenameWithoutExt(rest, true)
+	return dots + stem, tags, rest[len(stem):]
+}
+
+// untaggedPath removes the tags from the basename of path, keeping its
+// directory and extensions: themes/dark_linux_gtp.toml becomes
+// themes/dark.toml.
+func untaggedPath(path string, syntax TagSyntax) string {
+	dir, base := filepath.Split(path)
+	name, _, ext := syntax.split(base)
+	return dir + name + ext
+}
+
+// tagSatisfied tells whether tagMap satisfies a tag expression, of a when
+// condition or of a fragment name in a component with TagExpressions. It may
+// list alternatives separated by +, each of them a tag name, which
+// must be set, or name=value, which must be set to value, negated by a
+// leading -: bash+zsh, -darwin, os=linux. %XX escapes a character of a name
+// or a value, e.g. c%2B%2B for c++.
+func tagSatisfied(tag string, tagMap map[string]string) bool {
+	return termsSatisfied(tagTerms(tag), tagMap)
+}
+
+// termsSatisfied tells whether tagMap satisfies any of the alternatives.
+func termsSatisfied(terms []tagTerm, tagMap map[string]string) bool {
+	for _, term := range terms {
+		actual, ok := tagMap[term.name]
+		if term.hasValue {
+			ok = ok && actual == term.value
+		}
+		if ok != term.negated {
+			return true
+		}
+	}
+	return false
+}
+
+// Condition is the when of a paths.yml probe or a tags.yml implication: a tag
+// expression of a fragment name, or a list of them which must all be
+// satisfied.
+type Condition []string
+
+func (c *Condition) UnmarshalYAML(unmarshal func(any) error) error {
+	var tag string
+	if err := unmarshal(&tag); err == nil {
+		*c = Condition{tag}
+		return nil
+	}
+	var tags []string
+	if err := unmarshal(&tags); err != nil {
+		return err
+	}
+	*c = tags
+	return nil
+}
+
+// Satisfied tells whether tagMap satisfies every tag of the condition, see
+// tagSatisfied. An empty condition always is.
+func (c Condition) Satisfied(tagMap map[string]string) bool {
+	for _, tag := range c {
+		if !tagSatisfied(tag, tagMap) {
+			return false
+		}
+	}
+	return true
+}
+
+// tagTerm is an alternative of a tag of a fragment name.
+type tagTerm struct {
+	name     string
+	value    string
+	hasValue bool
+	negated  bool
+}
+
+// tagTerms parses the alternatives of a tag of a fragment name, see
+// tagSatisfied.
+func tagTerms(tag string) []tagTerm {
+	var terms []tagTerm
+	for _, s := range strings.Split(tag, "+") {
+		negated := strings.HasPrefix(s, "-")
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(s, "-"), "=")
+		terms = append(terms, tagTerm{name: unescapeTag(name), value: unescapeTag(value), hasValue: hasValue, negated: negated})
+	}
+	return terms
+}
+
+// tagTerms parses a tag of one of its fragment names, which is a plain tag
+// name unless TagExpressions is set.
+func (c Component) tagTerms(tag string) []tagTerm {
+	if !c.TagExpressions {
+		return []tagTerm{{name: tag}}
+	}
+	return tagTerms(tag)
+}
+
+// unescapeTag decodes the %XX escapes of s, if they are valid.
+func unescapeTag(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// extractTagsFromPath returns the tags of the basename of path. With the
+// underscore syntax, a hidden file such as .bashrc_linux has no tags, as
+// everything after its first dot is taken for its extensions, except in a
+// tree rule, whose targets are named without the tags (see untaggedPath).
+func extractTagsFromPath(path string, syntax TagSyntax, tree bool) (tags []string) {
+	base := filepath.Base(path)
+	underscore := syntax != TagSyntaxAt && syntax != TagSyntaxBraces
+	if underscore && !tree && strings.HasPrefix(base, ".") {
+		return []string{}
+	}
+	_, tags, _ = syntax.split(base)
+	return
+}
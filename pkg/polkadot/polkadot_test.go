@@ -0,0 +1,2075 @@
+package polkadot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/fatih/color"
+	"gopkg.in/yaml.v2"
+)
+
+func TestExpander(t *testing.T) {
+	t.Run("regular", func(t *testing.T) {
+		// GIVEN:
+		e := Expander{}
+		tagConf := map[string]map[string]string{
+			"linux": {
+				"systemctl": "/usr/bin/systemctl",
+			},
+			"arch": {
+				"pacman": "pacman",
+			},
+			"emacs": {
+				"emacsd": "emacsd",
+			},
+		}
+		entryTags := map[string]string{
+			"linux":  "linux",
+			"arch":   "arch",
+			"pacman": "/usr/bin/pacman",
+			"emacs":  "/usr/bin/emacs",
+		}
+		// WHEN:
+		acceptTags, rejectTags := e.Expand(tagConf, entryTags)
+		// THEN:
+		expectedAcceptTags := map[string]string{
+			"linux":     "linux",
+			"systemctl": "/usr/bin/systemctl",
+			"arch":      "arch",
+			"pacman":    "/usr/bin/pacman",
+			"emacs":     "/usr/bin/emacs",
+			"emacsd":    "emacsd",
+		}
+		expectedRejectTags := map[string]string{}
+		if !reflect.DeepEqual(acceptTags, expectedAcceptTags) {
+			t.Errorf("acceptTags: got %v, want %v", acceptTags, expectedAcceptTags)
+		}
+		if !reflect.DeepEqual(rejectTags, expectedRejectTags) {
+			t.Errorf("rejectTags: got %v, want %v", rejectTags, expectedRejectTags)
+		}
+	})
+	t.Run("hasRejectedTags", func(t *testing.T) {
+		// GIVEN:
+		e := Expander{}
+		tagConf := map[string]map[string]string{
+			"linux": {
+				"systemctl": "/usr/bin/systemctl",
+			},
+			"arch": {
+				"pacman": "pacman",
+			},
+			"emacs": {
+				"emacsd": "emacsd",
+			},
+		}
+		entryTags := map[string]string{
+			"linux":      "linux",
+			"arch":       "arch",
+			"pacman":     "/usr/bin/pacman",
+			"emacs":      "/usr/bin/emacs",
+			"!emacsd":    "!emacsd",
+			"!systemctl": "!systemctl",
+		}
+		// WHEN:
+		acceptTags, rejectTags := e.Expand(tagConf, entryTags)
+		// THEN:
+		expectedAcceptTags := map[string]string{
+			"arch":   "arch",
+			"emacs":  "/usr/bin/emacs",
+			"linux":  "linux",
+			"pacman": "/usr/bin/pacman",
+		}
+		expectedRejectTags := map[string]string{
+			"emacsd":    "!emacsd",
+			"systemctl": "!systemctl",
+		}
+		if !reflect.DeepEqual(acceptTags, expectedAcceptTags) {
+			t.Errorf("acceptTags: got %v, want %v", acceptTags, expectedAcceptTags)
+		}
+		if !reflect.DeepEqual(rejectTags, expectedRejectTags) {
+			t.Errorf("rejectTags: got %v, want %v", rejectTags, expectedRejectTags)
+		}
+	})
+	t.Run("hasDoubleNegative", func(t *testing.T) {
+		// GIVEN:
+		e := Expander{}
+		tagConf := map[string]map[string]string{
+			"linux": {
+				"systemctl": "/usr/bin/systemctl",
+			},
+			"arch": {
+				"pacman":      "pacman",
+				"!!systemctl": "/usr/bin/systemctl",
+			},
+			"emacs": {
+				"emacsd": "emacsd",
+			},
+		}
+		entryTags := map[string]string{
+			"linux":      "linux",
+			"arch":       "arch",
+			"pacman":     "/usr/bin/pacman",
+			"!systemctl": "!systemctl",
+			"emacs":      "/usr/bin/emacs",
+			"!emacsd":    "!emacsd",
+		}
+		// WHEN:
+		acceptTags, rejectTags := e.Expand(tagConf, entryTags)
+		// THEN:
+		expectedAcceptTags := map[string]string{
+			"arch":      "arch",
+			"emacs":     "/usr/bin/emacs",
+			"linux":     "linux",
+			"pacman":    "/usr/bin/pacman",
+			"systemctl": "/usr/bin/systemctl",
+		}
+		expectedRejectTags := map[string]string{
+			"emacsd": "!emacsd",
+		}
+		if !reflect.DeepEqual(acceptTags, expectedAcceptTags) {
+			t.Errorf("acceptTags: got %v, want %v", acceptTags, expectedAcceptTags)
+		}
+		if !reflect.DeepEqual(rejectTags, expectedRejectTags) {
+			t.Errorf("rejectTags: got %v, want %v", rejectTags, expectedRejectTags)
+		}
+	})
+	t.Run("provenance", func(t *testing.T) {
+		// GIVEN:
+		e := Expander{}
+		tagConf := map[string]map[string]string{
+			"linux": {
+				"systemctl": "/usr/bin/systemctl",
+				"editor":    "editor",
+			},
+			"editor": {
+				"emacs": "emacs",
+			},
+		}
+		entryTags := map[string]string{
+			"linux":      "linux",
+			"emacs":      "/usr/bin/emacs",
+			"!systemctl": "!systemctl",
+		}
+		// WHEN:
+		_, _, records := e.ExpandWithProvenance(tagConf, entryTags)
+		// THEN:
+		provenance := mergeTagRecords(records, nil, nil)
+		emacs := provenance["emacs"]
+		if len(emacs) != 2 {
+			t.Fatalf("emacs: expected 2 records, got %+v", emacs)
+		}
+		if emacs[0].Value != "/usr/bin/emacs" || emacs[0].Depth != 0 {
+			t.Errorf("emacs: expected entry tag to win, got %+v", emacs[0])
+		}
+		if emacs[1].Parent != "editor" || emacs[1].Depth != 2 {
+			t.Errorf("emacs: expected implication by editor at depth 2, got %+v", emacs[1])
+		}
+		systemctl := provenance["systemctl"]
+		if len(systemctl) != 2 || !systemctl[0].Negative || systemctl[0].Importance != 1 {
+			t.Errorf("systemctl: expected rejection to win, got %+v", systemctl)
+		}
+	})
+	t.Run("conditions", func(t *testing.T) {
+		// GIVEN implications guarded by when conditions
+		e := Expander{
+			Conditions: map[string]map[string]Condition{
+				"desktop": {"wayland": {"linux"}, "quartz": {"darwin"}, "!x11": {"linux", "-xwayland"}},
+			},
+			Tags: map[string]string{"linux": "linux", "desktop": "desktop"},
+		}
+		tagConf := map[string]map[string]string{
+			"desktop": {"wayland": "wayland", "quartz": "quartz", "!x11": "!x11"},
+			"wayland": {"x11": "x11"},
+		}
+		entryTags := map[string]string{"linux": "linux", "desktop": "desktop"}
+
+		// WHEN expanded
+		acceptTags, rejectTags, records := e.ExpandWithProvenance(tagConf, entryTags)
+
+		// THEN only the implications whose conditions the tags satisfy apply
+		expectedAcceptTags := map[string]string{"linux": "linux", "desktop": "desktop", "wayland": "wayland"}
+		if !reflect.DeepEqual(acceptTags, expectedAcceptTags) {
+			t.Errorf("acceptTags: got %v, want %v", acceptTags, expectedAcceptTags)
+		}
+		if !reflect.DeepEqual(rejectTags, map[string]string{"x11": "!x11"}) {
+			t.Errorf("rejectTags: got %v", rejectTags)
+		}
+		provenance := mergeTagRecords(records, nil, nil)
+		if x11 := provenance["x11"]; len(x11) != 2 || x11[0].When != "linux -xwayland" {
+			t.Errorf("x11: unexpected records: %+v", x11)
+		}
+	})
+	t.Run("probed", func(t *testing.T) {
+		// GIVEN tags probed by paths.yml
+		e := Expander{Probed: map[string]string{
+			"emacs":  "/usr/bin/emacs",
+			"editor": "/usr/bin/vi",
+			"tmux":   "/usr/bin/tmux",
+		}}
+		tagConf := map[string]map[string]string{
+			"linux": {"editor": "emacs", "!tmux": "!tmux"},
+			"emacs": {"gui-emacs": "gui-emacs"},
+		}
+		entryTags := map[string]string{"linux": "linux"}
+
+		// WHEN expanded
+		acceptTags, rejectTags, records := e.ExpandWithProvenance(tagConf, entryTags)
+
+		// THEN a probed tag implies its children, but loses to declarations
+		expectedAcceptTags := map[string]string{
+			"linux":     "linux",
+			"editor":    "emacs",
+			"emacs":     "/usr/bin/emacs",
+			"gui-emacs": "gui-emacs",
+		}
+		if !reflect.DeepEqual(acceptTags, expectedAcceptTags) {
+			t.Errorf("acceptTags: got %v, want %v", acceptTags, expectedAcceptTags)
+		}
+		if !reflect.DeepEqual(rejectTags, map[string]string{"tmux": "!tmux"}) {
+			t.Errorf("rejectTags: got %v", rejectTags)
+		}
+		// and the probes are left to the records of the Collector
+		for _, record := range records {
+			if record.Depth == 0 && record.Tag != "linux" {
+				t.Errorf("unexpected record: %+v", record)
+			}
+		}
+	})
+}
+
+func TestCollector(t *testing.T) {
+	c := Collector{}
+
+	t.Run("env/set", func(t *testing.T) {
+		t.Setenv("POLKADOT_TEST_VAR", "/test/path")
+		props, err := c.Collect(PathsConf{
+			"mykey": []CollectorEntry{{Type: "env", Name: "POLKADOT_TEST_VAR"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := props["mykey"]; got != "/test/path" {
+			t.Errorf("got %q, want %q", got, "/test/path")
+		}
+	})
+
+	t.Run("env/unset", func(t *testing.T) {
+		props, err := c.Collect(PathsConf{
+			"mykey": []CollectorEntry{{Type: "env", Name: "POLKADOT_TEST_NEVER_SET_XYZABC"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := props["mykey"]; ok {
+			t.Error("expected key to be absent for unset env var")
+		}
+	})
+
+	t.Run("file/exists", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "file.txt")
+		os.WriteFile(p, nil, 0644)
+		props, err := c.Collect(PathsConf{
+			"myfile": []CollectorEntry{{Type: "file", Path: p}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props["myfile"] == "" {
+			t.Error("expected myfile to be set")
+		}
+	})
+
+	t.Run("file/missing", func(t *testing.T) {
+		props, err := c.Collect(PathsConf{
+			"myfile": []CollectorEntry{{Type: "file", Path: "/nonexistent/path/file.txt"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := props["myfile"]; ok {
+			t.Error("expected key to be absent for missing file")
+		}
+	})
+
+	t.Run("file/rejects_dir", func(t *testing.T) {
+		props, err := c.Collect(PathsConf{
+			"myfile": []CollectorEntry{{Type: "file", Path: t.TempDir()}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := props["myfile"]; ok {
+			t.Error("expected key to be absent when path is a directory")
+		}
+	})
+
+	t.Run("dir/exists", func(t *testing.T) {
+		props, err := c.Collect(PathsConf{
+			"mydir": []CollectorEntry{{Type: "dir", Path: t.TempDir()}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props["mydir"] == "" {
+			t.Error("expected mydir to be set")
+		}
+	})
+
+	t.Run("dir/rejects_file", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "file.txt")
+		os.WriteFile(p, nil, 0644)
+		props, err := c.Collect(PathsConf{
+			"mydir": []CollectorEntry{{Type: "dir", Path: p}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := props["mydir"]; ok {
+			t.Error("expected key to be absent when path is a file")
+		}
+	})
+
+	t.Run("exec/found", func(t *testing.T) {
+		props, err := c.Collect(PathsConf{
+			"sh": []CollectorEntry{{Type: "exec"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props["sh"] == "" {
+			t.Skip("sh not found in PATH")
+		}
+		if !filepath.IsAbs(props["sh"]) {
+			t.Errorf("expected absolute path, got %q", props["sh"])
+		}
+	})
+
+	t.Run("provenance/last_wins", func(t *testing.T) {
+		t.Setenv("POLKADOT_TEST_VAR", "/test/path")
+		dir := t.TempDir()
+		props, records, err := c.CollectWithProvenance(PathsConf{
+			"mykey": []CollectorEntry{
+				{Type: "dir", Path: dir},
+				{Type: "env", Name: "POLKADOT_TEST_VAR"},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if props["mykey"] != "/test/path" {
+			t.Errorf("got %q, want %q", props["mykey"], "/test/path")
+		}
+		provenance := mergeTagRecords(nil, nil, records)
+		if got := provenance["mykey"]; len(got) != 2 || got[0].Via != "env POLKADOT_TEST_VAR" || got[1].Via != "dir "+dir {
+			t.Errorf("unexpected records: %+v", got)
+		}
+	})
+
+	t.Run("exec/missing", func(t *testing.T) {
+		props, err := c.Collect(PathsConf{
+			"nonexistent_binary_xyzabc": []CollectorEntry{{Type: "exec"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := props["nonexistent_binary_xyzabc"]; ok {
+			t.Error("expected key to be absent for missing binary")
+		}
+	})
+
+	t.Run("when", func(t *testing.T) {
+		t.Setenv("POLKADOT_TEST_VAR", "/test/path")
+		var pathsConf PathsConf
+		err := yaml.Unmarshal([]byte(`
+linux_only:
+  - type: env
+    name: POLKADOT_TEST_VAR
+    when: linux
+mac_only:
+  - type: env
+    name: POLKADOT_TEST_VAR
+    when: [darwin]
+not_mac:
+  - type: env
+    name: POLKADOT_TEST_VAR
+    when: [-darwin, os=linux]
+`), &pathsConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw := Collector{Tags: map[string]string{"linux": "linux", "os": "linux"}}
+		props, err := cw.Collect(pathsConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"linux_only": "/test/path", "not_mac": "/test/path"}
+		if !reflect.DeepEqual(props, want) {
+			t.Errorf("got %v, want %v", props, want)
+		}
+	})
+}
+
+func TestWeaver(t *testing.T) {
+	anyPat := regexp.MustCompile(`.*`)
+	w := Weaver{}
+
+	t.Run("tag_gating/accepts_matching", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "config_linux.conf"), []byte("content"), 0644)
+
+		sourceMap, err := w.Walk(DirComponent(dir), "", map[string]string{"linux": "linux"}, WeaverRule{Pattern: anyPat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sourceMap["config_linux.conf"]; !ok {
+			t.Error("expected config_linux.conf to be included")
+		}
+	})
+
+	t.Run("tag_gating/rejects_missing_tag", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "config_linux.conf"), []byte("content"), 0644)
+
+		sourceMap, err := w.Walk(DirComponent(dir), "", map[string]string{}, WeaverRule{Pattern: anyPat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sourceMap["config_linux.conf"]; ok {
+			t.Error("expected config_linux.conf to be excluded")
+		}
+	})
+
+	t.Run("tag_gating/requires_all_tags", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "config_linux_arch.conf"), []byte("content"), 0644)
+
+		sourceMap, err := w.Walk(DirComponent(dir), "", map[string]string{"linux": "linux"}, WeaverRule{Pattern: anyPat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sourceMap["config_linux_arch.conf"]; ok {
+			t.Error("expected config_linux_arch.conf to be excluded when arch tag is missing")
+		}
+	})
+
+	t.Run("tag_gating/expressions", func(t *testing.T) {
+		dir := t.TempDir()
+		for _, name := range []string{"a_-darwin.sh", "b_bash+zsh.sh", "c_os=linux.sh", "d_os=darwin.sh", "e_-os=darwin_bash.sh", "f_c%2B%2B.sh", "g_-bash+zsh.sh"} {
+			os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		}
+
+		tagMap := map[string]string{"linux": "linux", "os": "linux", "zsh": "zsh", "c++": "c++"}
+		component := DirComponent(dir)
+		component.TagExpressions = true
+		sourceMap, err := w.Walk(component, "", tagMap, WeaverRule{Pattern: anyPat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for name := range sourceMap {
+			got = append(got, name)
+		}
+		slices.Sort(got)
+		want := []string{"a_-darwin.sh", "b_bash+zsh.sh", "c_os=linux.sh", "f_c%2B%2B.sh", "g_-bash+zsh.sh"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("tag_gating/plain_names", func(t *testing.T) {
+		// GIVEN fragments whose tags look like expressions, in a component
+		// without tag_expressions
+		component := fstest.MapFS{
+			"foo_c++.sh":      {Data: []byte("c++")},
+			"bar_-darwin.sh":  {Data: []byte("-darwin")},
+			"baz_bash+zsh.sh": {Data: []byte("bash+zsh")},
+		}
+
+		// WHEN walked
+		tagMap := map[string]string{"c++": "c++", "zsh": "zsh"}
+		sourceMap, err := w.Walk(Component{Path: "common", FS: component}, "", tagMap, WeaverRule{Pattern: anyPat})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the tags are plain tag names
+		var got []string
+		for name := range sourceMap {
+			got = append(got, name)
+		}
+		if want := []string{"foo_c++.sh"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("tag_gating/hidden_files", func(t *testing.T) {
+		// GIVEN hidden fragments whose names look tagged
+		component := fstest.MapFS{
+			"dots/.bashrc_linux":     {Data: []byte("bashrc")},
+			"dots/.tmux_linux.conf":  {Data: []byte("tmux")},
+			"dots/profile_linux.sh":  {Data: []byte("profile")},
+			"tree/.gitconfig_darwin": {Data: []byte("gitconfig")},
+			"tree/.inputrc_linux":    {Data: []byte("inputrc")},
+		}
+		ruleConfMap := map[string]WeaverRule{
+			"~/.dots": {Directories: []string{"/dots"}, Pattern: anyPat},
+			"~":       {Directories: []string{"/tree"}, Pattern: anyPat, Tree: true},
+		}
+
+		// WHEN woven without the linux tag
+		entries, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{"darwin": "darwin"}, ruleConfMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN a concatenated rule includes the hidden files as it always
+		// has, while a tree rule gates them on the tags it strips
+		got := make(map[string][]string)
+		for _, entry := range entries {
+			for _, source := range entry.Sources {
+				got[entry.Path()] = append(got[entry.Path()], source.Name)
+			}
+		}
+		want := map[string][]string{
+			"~/.dots":      {".bashrc_linux", ".tmux_linux.conf"},
+			"~/.gitconfig": {".gitconfig_darwin"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("pattern_filtering", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, "match.conf"), []byte("content"), 0644)
+		os.WriteFile(filepath.Join(dir, "skip.txt"), []byte("content"), 0644)
+
+		pat := regexp.MustCompile(`\.conf$`)
+		sourceMap, err := w.Walk(DirComponent(dir), "", map[string]string{}, WeaverRule{Pattern: pat})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sourceMap["match.conf"]; !ok {
+			t.Error("expected match.conf to be included")
+		}
+		if _, ok := sourceMap["skip.txt"]; ok {
+			t.Error("expected skip.txt to be excluded by pattern")
+		}
+	})
+
+	t.Run("record/explanations", func(t *testing.T) {
+		root := t.TempDir()
+		dotsDir := filepath.Join(root, "dots")
+		os.MkdirAll(dotsDir, 0755)
+		os.WriteFile(filepath.Join(dotsDir, "00-base.sh"), []byte("x"), 0644)
+		os.WriteFile(filepath.Join(dotsDir, "10-linux_linux_wayland.sh"), []byte("x"), 0644)
+
+		ruleConfMap := map[string]WeaverRule{
+			"/tmp/sh":   {Directories: []string{"dots"}, Pattern: regexp.MustCompile(`\.sh$`)},
+			"/tmp/base": {Directories: []string{"dots"}, Pattern: regexp.MustCompile(`base`)},
+		}
+		rw := Weaver{Record: true}
+		if _, err := rw.Weave([]Component{DirComponent(root)}, map[string]string{"linux": "linux"}, ruleConfMap); err != nil {
+			t.Fatal(err)
+		}
+		type decision struct {
+			target, name   string
+			patternMatched bool
+			missingTags    []string
+		}
+		var got []decision
+		for _, e := range rw.Explanations {
+			got = append(got, decision{e.Target, e.Source.Name, e.PatternMatched, e.MissingTags})
+		}
+		want := []decision{
+			{"/tmp/base", "00-base.sh", true, nil},
+			{"/tmp/base", "10-linux_linux_wayland.sh", false, nil},
+			{"/tmp/sh", "00-base.sh", true, nil},
+			{"/tmp/sh", "10-linux_linux_wayland.sh", true, []string{"wayland"}},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("sort_stability", func(t *testing.T) {
+		root := t.TempDir()
+		dotsDir := filepath.Join(root, "dots")
+		os.MkdirAll(dotsDir, 0755)
+		os.WriteFile(filepath.Join(dotsDir, "b_source.conf"), []byte("b"), 0644)
+		os.WriteFile(filepath.Join(dotsDir, "a_source.conf"), []byte("a"), 0644)
+
+		ruleConfMap := map[string]WeaverRule{
+			"/tmp/b": {Directories: []string{"dots"}, Pattern: regexp.MustCompile(`b_source`)},
+			"/tmp/a": {Directories: []string{"dots"}, Pattern: regexp.MustCompile(`a_source`)},
+		}
+		entries, err := w.Weave([]Component{DirComponent(root)}, map[string]string{}, ruleConfMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("expected 2 entries, got %d", len(entries))
+		}
+		if entries[0].Path() != "/tmp/a" || entries[1].Path() != "/tmp/b" {
+			t.Errorf("unexpected order: %q, %q", entries[0].Path(), entries[1].Path())
+		}
+	})
+
+	t.Run("tree/mirrors_subtree", func(t *testing.T) {
+		// GIVEN a tree rule over two components, the second overriding a file
+		base := fstest.MapFS{
+			"config/alacritty/alacritty_linux.yml": {Data: []byte("linux")},
+			"config/alacritty/mac_darwin.yml":      {Data: []byte("mac")},
+			"config/alacritty/colors_gtp.toml":     {Data: []byte("colors")},
+			"config/alacritty/themes/dark.toml":    {Data: []byte("base dark")},
+		}
+		host := fstest.MapFS{
+			"config/alacritty/themes/dark.toml": {Data: []byte("host dark")},
+		}
+		ruleConfMap := map[string]WeaverRule{
+			"~/.config/alacritty/": {Directories: []string{"/config/alacritty"}, Pattern: anyPat, Tree: true},
+		}
+
+		// WHEN woven
+		entries, err := w.Weave([]Component{{Path: "base", FS: base}, {Path: "host", FS: host}}, map[string]string{"linux": "linux", "gtp": "gtp"}, ruleConfMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN each selected file is a target of its own, without its tags
+		got := make(map[string]string)
+		for _, entry := range entries {
+			if len(entry.Sources) != 1 || !entry.Target.Tree {
+				t.Fatalf("unexpected entry %+v", entry)
+			}
+			got[entry.Path()] = entry.Sources[0].Path
+		}
+		want := map[string]string{
+			"~/.config/alacritty/alacritty.yml":    "base/config/alacritty/alacritty_linux.yml",
+			"~/.config/alacritty/colors.toml":      "base/config/alacritty/colors_gtp.toml",
+			"~/.config/alacritty/themes/dark.toml": "host/config/alacritty/themes/dark.toml",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("tree/keeps_source_mode", func(t *testing.T) {
+		// GIVEN a tree with a script, a private file and a file without a mode
+		component := fstest.MapFS{
+			"home/bin/script.sh":   {Data: []byte("#!/bin/sh\n"), Mode: 0755},
+			"home/.netrc":          {Data: []byte("machine\n"), Mode: 0600},
+			"home/.config/app.yml": {Data: []byte("app\n")},
+		}
+		ruleMode := 0644
+		for _, tc := range []struct {
+			mode *int
+			want map[string]int
+		}{
+			{want: map[string]int{"~/bin/script.sh": 0755, "~/.netrc": 0600}},
+			{mode: &ruleMode, want: map[string]int{"~/bin/script.sh": 0644, "~/.netrc": 0644, "~/.config/app.yml": 0644}},
+		} {
+			ruleConfMap := map[string]WeaverRule{
+				"~": {Directories: []string{"/home"}, Pattern: anyPat, Tree: true, Mode: tc.mode},
+			}
+
+			// WHEN woven
+			entries, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{}, ruleConfMap)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// THEN each target has the mode of the rule, or else of its source
+			got := make(map[string]int)
+			for _, entry := range entries {
+				if entry.Target.Mode != nil {
+					got[entry.Path()] = *entry.Target.Mode
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		}
+	})
+
+	t.Run("tree/tagged_variants_collide", func(t *testing.T) {
+		component := fstest.MapFS{
+			"dots/a_linux.conf": {Data: []byte("linux")},
+			"dots/a_work.conf":  {Data: []byte("work")},
+		}
+		ruleConfMap := map[string]WeaverRule{
+			"/tmp/dots": {Directories: []string{"dots"}, Pattern: anyPat, Tree: true},
+		}
+		_, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{"linux": "linux", "work": "work"}, ruleConfMap)
+		want := `rule "/tmp/dots": a_linux.conf and a_work.conf both generate a.conf`
+		if err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	})
+
+	t.Run("templated_paths", func(t *testing.T) {
+		// GIVEN one rule covering the macOS and the XDG layouts
+		component := fstest.MapFS{
+			"alacritty/mac/a.toml":   {Data: []byte("mac")},
+			"alacritty/linux/a.toml": {Data: []byte("linux")},
+		}
+		ruleConfMap := map[string]WeaverRule{
+			`{{if hasTag "darwin"}}~/Library/alacritty.toml{{else}}~/.config/alacritty.toml{{end}}`: {
+				Directories: []string{`/alacritty/{{if hasTag "darwin"}}mac{{else}}linux{{end}}`},
+				Pattern:     anyPat,
+			},
+			`{{if hasTag "darwin"}}~/Library/skhdrc{{end}}`: {Directories: []string{"/alacritty"}, Pattern: anyPat},
+		}
+
+		// WHEN woven on linux
+		entries, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{"linux": "linux"}, ruleConfMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the paths are rendered, and an empty path disables its rule
+		if len(entries) != 1 || entries[0].Path() != "~/.config/alacritty.toml" || entries[0].Sources[0].Path != "c/alacritty/linux/a.toml" {
+			t.Errorf("unexpected entries %+v", entries)
+		}
+	})
+
+	t.Run("templated_paths/same_target", func(t *testing.T) {
+		component := fstest.MapFS{"dots/a.conf": {Data: []byte("a")}}
+		ruleConfMap := map[string]WeaverRule{
+			"~/.config/{{.app}}.conf": {Directories: []string{"dots"}, Pattern: anyPat},
+			"~/.config/a.conf":        {Directories: []string{"dots"}, Pattern: anyPat},
+		}
+		_, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{"app": "a"}, ruleConfMap)
+		want := `~/.config/a.conf is generated by both rule "~/.config/a.conf" and rule "~/.config/{{.app}}.conf"`
+		if err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	})
+
+	t.Run("templated_paths/missing_tag", func(t *testing.T) {
+		// GIVEN paths referring to a tag which is not set
+		component := fstest.MapFS{"dots/a.conf": {Data: []byte("a")}}
+		for _, tc := range []struct{ rule, dir, text string }{
+			{rule: "{{.xdg}}/alacritty.yml", dir: "dots", text: "{{.xdg}}/alacritty.yml"},
+			{rule: "~/.alacritty.yml", dir: "/{{.xdg}}", text: "/{{.xdg}}"},
+		} {
+			ruleConfMap := map[string]WeaverRule{tc.rule: {Directories: []string{tc.dir}, Pattern: anyPat}}
+
+			// WHEN woven
+			_, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{"linux": "linux"}, ruleConfMap)
+
+			// THEN the rule and the tag are reported instead of a root path
+			want := fmt.Sprintf(`rule %q: missing tag "xdg" in %q (use hasTag or index for an optional tag)`, tc.rule, tc.text)
+			if err == nil || err.Error() != want {
+				t.Errorf("got %v, want %s", err, want)
+			}
+		}
+
+		// but index leaves an optional part empty
+		ruleConfMap := map[string]WeaverRule{
+			`~/{{index . "xdg" | default ".config"}}/alacritty.yml`: {Directories: []string{"dots"}, Pattern: anyPat},
+		}
+		entries, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{}, ruleConfMap)
+		if err != nil || len(entries) != 1 || entries[0].Path() != "~/.config/alacritty.yml" {
+			t.Errorf("got %+v, %v", entries, err)
+		}
+	})
+
+	t.Run("dir_outside_component", func(t *testing.T) {
+		// GIVEN rules whose directories escape the component
+		component := fstest.MapFS{"shared/a.conf": {Data: []byte("a")}}
+		for _, tc := range []struct{ dir, rendered string }{
+			{"../shared", "../shared"},
+			{"/{{.up}}/shared", "/../shared"},
+			{"dots/../../shared", "dots/../../shared"},
+		} {
+			ruleConfMap := map[string]WeaverRule{"~/.a.conf": {Directories: []string{tc.dir}, Pattern: anyPat}}
+
+			// WHEN woven
+			_, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{"up": ".."}, ruleConfMap)
+
+			// THEN the rule fails instead of reading another directory
+			want := fmt.Sprintf(`rule "~/.a.conf": dir %q is outside the component`, tc.rendered)
+			if err == nil || err.Error() != want {
+				t.Errorf("got %v, want %s", err, want)
+			}
+		}
+	})
+
+	t.Run("tree/target_of_two_rules", func(t *testing.T) {
+		component := fstest.MapFS{"dots/a.conf": {Data: []byte("a")}}
+		ruleConfMap := map[string]WeaverRule{
+			"/tmp/dots":        {Directories: []string{"dots"}, Pattern: anyPat, Tree: true},
+			"/tmp/dots/a.conf": {Directories: []string{"dots"}, Pattern: anyPat},
+		}
+		_, err := w.Weave([]Component{{Path: "c", FS: component}}, map[string]string{}, ruleConfMap)
+		want := `/tmp/dots/a.conf is generated by both rule "/tmp/dots" and rule "/tmp/dots/a.conf"`
+		if err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	})
+}
+
+func TestGenerator(t *testing.T) {
+	g := Generator{NormalizeJoin: true}
+
+	t.Run("text/concatenation", func(t *testing.T) {
+		dir := t.TempDir()
+		p1 := filepath.Join(dir, "a.conf")
+		p2 := filepath.Join(dir, "b.conf")
+		os.WriteFile(p1, []byte("aaa\n"), 0644)
+		os.WriteFile(p2, []byte("bbb\n"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "a.conf", Path: p1, Tags: []string{}},
+				{Name: "b.conf", Path: p2, Tags: []string{}},
+			},
+			Target: DotTarget{Path: out},
+		}
+		if _, err := g.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "aaa\n\nbbb\n" {
+			t.Errorf("got %q, want %q", string(content), "aaa\n\nbbb\n")
+		}
+	})
+
+	t.Run("gtp/template_rendering", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "config_gtp.conf")
+		os.WriteFile(p, []byte(`home={{.home}}`), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "config_gtp.conf", Path: p, Tags: []string{"gtp"}},
+			},
+			Target: DotTarget{Path: out},
+		}
+		if _, err := g.Generate(entry, map[string]string{"home": "/home/user"}); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "home=/home/user\n" {
+			t.Errorf("got %q, want %q", string(content), "home=/home/user\n")
+		}
+	})
+
+	t.Run("normalize_join/strips_extra_newlines", func(t *testing.T) {
+		dir := t.TempDir()
+		p1 := filepath.Join(dir, "a.conf")
+		p2 := filepath.Join(dir, "b.conf")
+		os.WriteFile(p1, []byte("aaa\n\n\n"), 0644)
+		os.WriteFile(p2, []byte("bbb"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "a.conf", Path: p1, Tags: []string{}},
+				{Name: "b.conf", Path: p2, Tags: []string{}},
+			},
+			Target: DotTarget{Path: out},
+		}
+		gn := Generator{NormalizeJoin: true}
+		if _, err := gn.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "aaa\n\nbbb\n" {
+			t.Errorf("got %q, want %q", string(content), "aaa\n\nbbb\n")
+		}
+	})
+
+	t.Run("normalize_join/adds_missing_newline", func(t *testing.T) {
+		dir := t.TempDir()
+		p1 := filepath.Join(dir, "a.conf")
+		p2 := filepath.Join(dir, "b.conf")
+		os.WriteFile(p1, []byte("aaa"), 0644)
+		os.WriteFile(p2, []byte("bbb"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "a.conf", Path: p1, Tags: []string{}},
+				{Name: "b.conf", Path: p2, Tags: []string{}},
+			},
+			Target: DotTarget{Path: out},
+		}
+		gn := Generator{NormalizeJoin: true}
+		if _, err := gn.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "aaa\n\nbbb\n" {
+			t.Errorf("got %q, want %q", string(content), "aaa\n\nbbb\n")
+		}
+	})
+
+	t.Run("normalize_join/collapses_excess_newlines", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n\n\nbbb"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out},
+		}
+		gn := Generator{NormalizeJoin: true}
+		if _, err := gn.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "aaa\n\nbbb\n" {
+			t.Errorf("got %q, want %q", string(content), "aaa\n\nbbb\n")
+		}
+	})
+
+	t.Run("normalize_join/raw_preserves_content", func(t *testing.T) {
+		dir := t.TempDir()
+		p1 := filepath.Join(dir, "a.conf")
+		p2 := filepath.Join(dir, "b.conf")
+		os.WriteFile(p1, []byte("aaa\n\n"), 0644)
+		os.WriteFile(p2, []byte("bbb"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "a.conf", Path: p1, Tags: []string{}},
+				{Name: "b.conf", Path: p2, Tags: []string{}},
+			},
+			Target: DotTarget{Path: out},
+		}
+		gr := Generator{NormalizeJoin: false}
+		if _, err := gr.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "aaa\n\nbbb" {
+			t.Errorf("got %q, want %q", string(content), "aaa\n\nbbb")
+		}
+	})
+
+	t.Run("gtp/missingkey_zero", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "config_gtp.conf")
+		os.WriteFile(p, []byte(`val={{.undefined}}`), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "config_gtp.conf", Path: p, Tags: []string{"gtp"}},
+			},
+			Target: DotTarget{Path: out},
+		}
+		if _, err := g.Generate(entry, map[string]string{}); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "val=\n" {
+			t.Errorf("got %q, want %q", string(content), "val=\n")
+		}
+	})
+
+	t.Run("gtp/strict_missing_tag", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "config_gtp.conf")
+		os.WriteFile(p, []byte("editor={{.editor}}\nshell={{.shlel}}\n"), 0644)
+		entry := DotEntry{
+			Sources: []DotSource{
+				{Name: "config_gtp.conf", Path: p, Tags: []string{"gtp"}},
+			},
+			Target: DotTarget{Path: filepath.Join(dir, "out.conf")},
+		}
+
+		gs := Generator{NormalizeJoin: true, Strict: true}
+		_, err := gs.Render(entry, map[string]string{"editor": "vi"})
+		var missing *MissingTagError
+		if !errors.As(err, &missing) {
+			t.Fatalf("got %v, want a MissingTagError", err)
+		}
+		want := MissingTagError{Path: p, Line: 2, Tag: "shlel"}
+		if *missing != want {
+			t.Errorf("got %+v, want %+v", *missing, want)
+		}
+
+		// a rule can turn it off
+		lenient := false
+		entry.Target.Strict = &lenient
+		if _, err := gs.Render(entry, map[string]string{"editor": "vi"}); err != nil {
+			t.Errorf("got %v, want no error", err)
+		}
+	})
+
+	t.Run("mode/applied_to_existing", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		os.WriteFile(out, []byte("old\n"), 0644)
+		mode := 0600
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out, Mode: &mode},
+		}
+		if _, err := g.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(out)
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("got mode %o, want %o", info.Mode().Perm(), 0600)
+		}
+	})
+
+	t.Run("atomic/keeps_target_on_error", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "config_gtp.conf")
+		os.WriteFile(p, []byte(`{{.broken`), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		os.WriteFile(out, []byte("old\n"), 0644)
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "config_gtp.conf", Path: p, Tags: []string{"gtp"}}},
+			Target:  DotTarget{Path: out},
+		}
+		if _, err := g.Generate(entry, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "old\n" {
+			t.Errorf("got %q, want %q", string(content), "old\n")
+		}
+		leftovers, _ := filepath.Glob(filepath.Join(dir, ".out.conf.polkadot-*"))
+		if len(leftovers) != 0 {
+			t.Errorf("expected no temporary files, got %v", leftovers)
+		}
+	})
+
+	t.Run("atomic/keeps_existing_mode", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		os.WriteFile(out, []byte("old\n"), 0600)
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out},
+		}
+		result, err := g.Generate(entry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(out)
+		if info.Mode().Perm() != 0600 || result.Mode != 0600 {
+			t.Errorf("got mode %o (result %o), want %o", info.Mode().Perm(), result.Mode, 0600)
+		}
+	})
+
+	t.Run("outcome", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		mode := 0644
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out, Mode: &mode},
+		}
+		generate := func() Outcome {
+			t.Helper()
+			result, err := g.Generate(entry, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return result.Outcome
+		}
+
+		if got := generate(); got != OutcomeCreated {
+			t.Errorf("got %v, want %v", got, OutcomeCreated)
+		}
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		os.Chtimes(out, past, past)
+		if got := generate(); got != OutcomeUnchanged {
+			t.Errorf("got %v, want %v", got, OutcomeUnchanged)
+		}
+		if info, _ := os.Stat(out); !info.ModTime().Equal(past) {
+			t.Error("expected an unchanged target not to be rewritten")
+		}
+		os.Chmod(out, 0600)
+		if got := generate(); got != OutcomeModeChanged {
+			t.Errorf("got %v, want %v", got, OutcomeModeChanged)
+		}
+		if info, _ := os.Stat(out); info.Mode().Perm() != 0644 {
+			t.Errorf("got mode %o, want %o", info.Mode().Perm(), 0644)
+		}
+		os.WriteFile(p, []byte("bbb\n"), 0644)
+		if got := generate(); got != OutcomeUpdated {
+			t.Errorf("got %v, want %v", got, OutcomeUpdated)
+		}
+	})
+
+	t.Run("diff/new_file", func(t *testing.T) {
+		color.NoColor = true
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out},
+		}
+		var buf bytes.Buffer
+		if err := g.Diff(&buf, entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := "new file " + out + " (mode: 0644)\n--- /dev/null\n+++ " + out + "\n@@ -0,0 +1 @@\n+aaa\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+		if _, err := os.Stat(out); !os.IsNotExist(err) {
+			t.Error("expected diff not to create the target")
+		}
+	})
+
+	t.Run("diff/mode_change", func(t *testing.T) {
+		color.NoColor = true
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+
+		out := filepath.Join(dir, "out.conf")
+		os.WriteFile(out, []byte("aaa\n"), 0644)
+		mode := 0600
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out, Mode: &mode},
+		}
+		var buf bytes.Buffer
+		if err := g.Diff(&buf, entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := "mode change " + out + " (0644 => 0600)\n"
+		if buf.String() != want {
+			t.Errorf("got %q, want %q", buf.String(), want)
+		}
+	})
+
+	t.Run("link/creates_and_keeps", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "init.lua")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+		out := filepath.Join(dir, "nvim", "init.lua")
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "init.lua", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out, Link: true},
+		}
+		result, err := g.Generate(entry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Outcome != OutcomeCreated || result.Link != p {
+			t.Errorf("got %v -> %q, want created -> %q", result.Outcome, result.Link, p)
+		}
+		if link, err := os.Readlink(out); err != nil || link != p {
+			t.Errorf("got link %q (%v), want %q", link, err, p)
+		}
+		result, err = g.Generate(entry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Outcome != OutcomeUnchanged {
+			t.Errorf("got %v, want unchanged", result.Outcome)
+		}
+	})
+
+	t.Run("link/replaces_file_with_backup", func(t *testing.T) {
+		// GIVEN a target which is a regular file
+		dir := t.TempDir()
+		p := filepath.Join(dir, "init.lua")
+		os.WriteFile(p, []byte("new\n"), 0644)
+		out := filepath.Join(dir, "out.lua")
+		os.WriteFile(out, []byte("old\n"), 0600)
+		backup := NewBackupRun(filepath.Join(dir, "backups"), filepath.Join(dir, "manifest.json"))
+		gb := Generator{NormalizeJoin: true, Backup: backup}
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "init.lua", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out, Link: true},
+		}
+
+		// WHEN it is linked
+		result, err := gb.Generate(entry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the file is replaced, and comes back on rollback
+		if result.Outcome != OutcomeUpdated {
+			t.Errorf("got %v, want updated", result.Outcome)
+		}
+		if info, err := os.Lstat(out); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("expected a link (%v)", err)
+		}
+		if err := backup.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		info, _ := os.Lstat(out)
+		if string(content) != "old\n" || info.Mode() != 0600 {
+			t.Errorf("got %q (mode %v), want %q (mode 0600)", content, info.Mode(), "old\n")
+		}
+	})
+
+	t.Run("link/cannot_link", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "init_gtp.lua")
+		os.WriteFile(p, []byte("{{.name}}\n"), 0644)
+		out := filepath.Join(dir, "out.lua")
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "init_gtp.lua", Path: p, Tags: []string{"gtp"}}},
+			Target:  DotTarget{Path: out, Link: true},
+		}
+		if _, err := g.Generate(entry, nil); err == nil {
+			t.Fatal("expected an error for a template")
+		}
+
+		entry.Target.LinkFallback = "copy"
+		result, err := g.Generate(entry, map[string]string{"name": "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Lstat(out)
+		if result.Link != "" || info.Mode()&os.ModeSymlink != 0 {
+			t.Error("expected a copy")
+		}
+	})
+
+	t.Run("link/replaced_by_file", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n"), 0644)
+		out := filepath.Join(dir, "out.conf")
+		os.Symlink(p, out)
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out},
+		}
+		result, err := g.Generate(entry, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Lstat(out)
+		if result.Outcome != OutcomeUpdated || info.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("got %v (mode %v), want updated regular file", result.Outcome, info.Mode())
+		}
+	})
+
+	t.Run("tree/copies_as_is", func(t *testing.T) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("aaa\n\n\n\nbbb"), 0644)
+		out := filepath.Join(dir, "out.conf")
+		entry := DotEntry{
+			Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+			Target:  DotTarget{Path: out, Tree: true},
+		}
+		if _, err := g.Generate(entry, nil); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "aaa\n\n\n\nbbb" {
+			t.Errorf("got %q, want %q", content, "aaa\n\n\n\nbbb")
+		}
+	})
+}
+
+func TestApp(t *testing.T) {
+	t.Run("new/defaults", func(t *testing.T) {
+		app := New(Options{DotfilesDir: "/dotfiles"})
+		if app.entryPath != "entry.yml" {
+			t.Errorf("entryPath = %q", app.entryPath)
+		}
+		if app.stateDirPath != "/dotfiles/.polkadot" {
+			t.Errorf("stateDirPath = %q", app.stateDirPath)
+		}
+	})
+
+	t.Run("prepare_and_execute", func(t *testing.T) {
+		// GIVEN a dotfiles root with one component directory
+		dir := t.TempDir()
+		out := filepath.Join(dir, "home", ".bashrc")
+		os.WriteFile(filepath.Join(dir, "entry.yml"), []byte("linux:\n"), 0644)
+		os.MkdirAll(filepath.Join(dir, "common", "bash"), 0755)
+		os.WriteFile(filepath.Join(dir, "common", "rules.yml"), []byte(out+":\n  dir: /bash\n  pat: \\.sh$\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "common", "bash", "00-base.sh"), []byte("base\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "common", "bash", "10-linux_linux.sh"), []byte("linux\n"), 0644)
+		os.WriteFile(filepath.Join(dir, "common", "bash", "20-mac_darwin.sh"), []byte("mac\n"), 0644)
+
+		// WHEN the pipeline runs through the exported API
+		var buf bytes.Buffer
+		app := New(Options{
+			DotfilesDir: dir,
+			Components:  []Component{DirComponent(filepath.Join(dir, "common"))},
+			Out:         &buf,
+		})
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		plan, err := app.Plan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the plan, the results and the written target agree
+		if len(plan.Entries) != 1 || len(plan.Entries[0].Sources) != 2 {
+			t.Fatalf("plan entries = %+v", plan.Entries)
+		}
+		results := app.Results()
+		if len(results) != 1 || results[0].Path != out || results[0].Outcome != OutcomeCreated {
+			t.Errorf("results = %+v", results)
+		}
+		content, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "base\n\nlinux\n" {
+			t.Errorf("content = %q", content)
+		}
+		if _, err := os.Stat(filepath.Join(dir, StateDirName, manifestFileName)); err != nil {
+			t.Error("expected the manifest in the state directory")
+		}
+	})
+
+	t.Run("dest_dir", func(t *testing.T) {
+		// GIVEN a rule writing into the home directory
+		dir := t.TempDir()
+		dotfilesFS := fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}}
+		componentFS := fstest.MapFS{
+			"rules.yml":       {Data: []byte("~/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/00-base.sh": {Data: []byte("base\n")},
+		}
+
+		// WHEN it is staged into a destination directory with another home
+		destDir := filepath.Join(dir, "out")
+		app := New(Options{
+			DotfilesDir: dir,
+			DotfilesFS:  dotfilesFS,
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			Home:        "/home/user",
+			DestDir:     destDir,
+		})
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the target and the state are both under the destination
+		out := filepath.Join(destDir, "home", "user", ".bashrc")
+		if content, err := os.ReadFile(out); err != nil || string(content) != "base\n" {
+			t.Errorf("got %q (%v), want %q", content, err, "base\n")
+		}
+		if _, err := os.Stat(filepath.Join(destDir, StateDirName, manifestFileName)); err != nil {
+			t.Error("expected the manifest under the destination")
+		}
+		if _, err := os.Stat(filepath.Join(dir, StateDirName)); !os.IsNotExist(err) {
+			t.Error("expected no state in the dotfiles root")
+		}
+	})
+
+	t.Run("home/prune_keeps_real_home", func(t *testing.T) {
+		// GIVEN a rule generated into the real home directory
+		dir := t.TempDir()
+		realHome := filepath.Join(dir, "realhome")
+		stage := filepath.Join(dir, "stage")
+		t.Setenv("HOME", realHome)
+		dotfilesFS := fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}}
+		componentFS := fstest.MapFS{
+			"rules.yml":       {Data: []byte("~/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/00-base.sh": {Data: []byte("base\n")},
+		}
+		build := func(home string, prune bool) {
+			app := New(Options{
+				DotfilesDir: dir,
+				DotfilesFS:  dotfilesFS,
+				Components:  []Component{{Path: "common", FS: componentFS}},
+				Home:        home,
+			})
+			if err := app.Prepare(); err != nil {
+				t.Fatal(err)
+			}
+			if err := app.Execute(); err != nil {
+				t.Fatal(err)
+			}
+			if prune {
+				if err := app.Prune(false); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		build("", false)
+
+		// WHEN it is staged into another home with -prune
+		build(stage, true)
+
+		// THEN the real dotfile stays, and the staged run keeps its own state
+		if content, err := os.ReadFile(filepath.Join(realHome, ".bashrc")); err != nil || string(content) != "base\n" {
+			t.Errorf("got %q (%v), want the real .bashrc kept", content, err)
+		}
+		if content, err := os.ReadFile(filepath.Join(stage, ".bashrc")); err != nil || string(content) != "base\n" {
+			t.Errorf("got %q (%v), want the staged .bashrc", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(stage, StateDirName, manifestFileName)); err != nil {
+			t.Error("expected the manifest under the staged home")
+		}
+	})
+
+	t.Run("in_memory", func(t *testing.T) {
+		// GIVEN the dotfiles root and a component in memory
+		dotfilesFS := fstest.MapFS{
+			"entry.yml": {Data: []byte("linux:\n")},
+		}
+		componentFS := fstest.MapFS{
+			"rules.yml":                 {Data: []byte("/home/user/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/00-base.sh":           {Data: []byte("base\n")},
+			"bash/10-linux_linux.sh":    {Data: []byte("linux\n")},
+			"bash/20-prompt_gtp.sh":     {Data: []byte("PS1={{.linux}}\n")},
+			"bash/30-mac_darwin.sh":     {Data: []byte("mac\n")},
+			"bash/lib/40-nested_gtp.sh": {Data: []byte("nested\n")},
+		}
+		targets := &MemTargetFS{}
+
+		// WHEN the pipeline writes through a MemTargetFS
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  dotfilesFS,
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     targets,
+		})
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the target is only in memory, and the sources keep their paths
+		if got := targets.Paths(); !reflect.DeepEqual(got, []string{"/home/user/.bashrc"}) {
+			t.Fatalf("paths = %v", got)
+		}
+		file := targets.Files["/home/user/.bashrc"]
+		want := "base\n\nlinux\n\nPS1=linux\n\nnested\n"
+		if string(file.Content) != want || file.Mode != 0644 {
+			t.Errorf("got %q (mode %04o), want %q (mode 0644)", file.Content, file.Mode, want)
+		}
+		var sourcePaths []string
+		for _, source := range app.Entries()[0].Sources {
+			sourcePaths = append(sourcePaths, source.Path)
+		}
+		wantPaths := []string{"common/bash/00-base.sh", "common/bash/10-linux_linux.sh", "common/bash/20-prompt_gtp.sh", "common/bash/lib/40-nested_gtp.sh"}
+		if !reflect.DeepEqual(sourcePaths, wantPaths) {
+			t.Errorf("got %v, want %v", sourcePaths, wantPaths)
+		}
+
+		// WHEN run again, nothing changes
+		app = New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  dotfilesFS,
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    app.stateDirPath,
+			Targets:     targets,
+		})
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+		if results := app.Results(); results[0].Outcome != OutcomeUnchanged {
+			t.Errorf("outcome = %v, want unchanged", results[0].Outcome)
+		}
+	})
+
+	t.Run("in_memory/no_state", func(t *testing.T) {
+		// GIVEN targets in memory and no state dir
+		dotfilesDir := t.TempDir()
+		componentFS := fstest.MapFS{
+			"rules.yml":       {Data: []byte("/home/user/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/00-base.sh": {Data: []byte("base\n")},
+		}
+		targets := &MemTargetFS{}
+		targets.WriteFile("/home/user/.bashrc", []byte("old\n"), 0644)
+
+		// WHEN the pipeline overwrites a target
+		app := New(Options{
+			DotfilesDir: dotfilesDir,
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			Targets:     targets,
+		})
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN neither a manifest nor a backup is written to the disk
+		if _, err := os.Stat(filepath.Join(dotfilesDir, StateDirName)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("state dir: got %v, want it absent", err)
+		}
+		if got := string(targets.Files["/home/user/.bashrc"].Content); got != "base\n" {
+			t.Errorf("got %q, want %q", got, "base\n")
+		}
+
+		// nor without a dotfiles dir, in the working directory
+		if app := New(Options{DotfilesFS: fstest.MapFS{}}); app.stateDirPath != "" {
+			t.Errorf("state dir: got %q, want none", app.stateDirPath)
+		}
+	})
+
+	t.Run("resolve/probed_tags_imply", func(t *testing.T) {
+		// GIVEN a probe found by paths.yml whose tag implies another one,
+		// which conditions a second probe
+		t.Setenv("POLKADOT_TEST_EMACS", "/usr/bin/emacs")
+		t.Setenv("POLKADOT_TEST_DISPLAY", ":0")
+		componentFS := fstest.MapFS{
+			"tags.yml":  {Data: []byte("emacs:\n  gui: gui\n")},
+			"paths.yml": {Data: []byte("emacs:\n  - type: env\n    name: POLKADOT_TEST_EMACS\ndisplay:\n  - type: env\n    name: POLKADOT_TEST_DISPLAY\n    when: gui\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     &MemTargetFS{},
+		})
+
+		// WHEN prepared
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the tags settle with the implied tag and both probes
+		for tag, want := range map[string]string{"emacs": "/usr/bin/emacs", "gui": "gui", "display": ":0"} {
+			if got := app.tagMap[tag]; got != want {
+				t.Errorf("%s: got %q, want %q", tag, got, want)
+			}
+		}
+		if gui := app.tagProvenance["gui"]; len(gui) != 1 || gui[0].Parent != "emacs" || gui[0].Source != "common/tags.yml" {
+			t.Errorf("gui: unexpected records: %+v", gui)
+		}
+	})
+
+	t.Run("resolve/oscillation", func(t *testing.T) {
+		// GIVEN probes which undo each other
+		t.Setenv("POLKADOT_TEST_VAR", "set")
+		componentFS := fstest.MapFS{
+			"paths.yml": {Data: []byte("a:\n  - type: env\n    name: POLKADOT_TEST_VAR\n    when: -b\nb:\n  - type: env\n    name: POLKADOT_TEST_VAR\n    when: a\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     &MemTargetFS{},
+		})
+
+		// WHEN prepared, THEN it fails naming them
+		want := "resolve tags: the when conditions and paths.yml probes do not settle, a, b found and lost in turn"
+		if err := app.Prepare(); err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	})
+
+	t.Run("resolve/conditional_implications", func(t *testing.T) {
+		// GIVEN implications of tags.yml conditioned on declared and probed tags
+		t.Setenv("POLKADOT_TEST_EMACS", "/usr/bin/emacs")
+		componentFS := fstest.MapFS{
+			"tags.yml": {Data: []byte(`desktop:
+  wayland: {when: linux}
+  quartz: {value: quartz, when: darwin}
+  gui-emacs: {value: gui, when: emacs}
+  bar: waybar
+`)},
+			"paths.yml": {Data: []byte("emacs:\n  - type: env\n    name: POLKADOT_TEST_EMACS\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\ndesktop:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     &MemTargetFS{},
+		})
+
+		// WHEN prepared
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the satisfied implications apply
+		for tag, want := range map[string]string{"wayland": "wayland", "gui-emacs": "gui", "bar": "waybar", "quartz": ""} {
+			if got := app.tagMap[tag]; got != want {
+				t.Errorf("%s: got %q, want %q", tag, got, want)
+			}
+		}
+		if wayland := app.tagProvenance["wayland"]; len(wayland) != 1 || wayland[0].String() != "wayland (common/tags.yml: implied by desktop at depth 1, when linux)" {
+			t.Errorf("wayland: unexpected records: %+v", wayland)
+		}
+	})
+
+	t.Run("resolve/contradiction", func(t *testing.T) {
+		// GIVEN an implication which undoes itself
+		componentFS := fstest.MapFS{
+			"tags.yml": {Data: []byte("linux:\n  b: {when: -b}\n")},
+		}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     &MemTargetFS{},
+		})
+
+		// WHEN prepared, THEN it fails naming it
+		want := "resolve tags: the when conditions and paths.yml probes do not settle, b found and lost in turn"
+		if err := app.Prepare(); err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	})
+
+	t.Run("front_matter", func(t *testing.T) {
+		// GIVEN a component whose fragments may start with a front matter
+		dotfilesFS := fstest.MapFS{
+			"entry.yml": {Data: []byte("linux:\nbash:\n")},
+		}
+		componentFS := fstest.MapFS{
+			"component.yml":   {Data: []byte("front_matter: true\n")},
+			"rules.yml":       {Data: []byte("/home/user/.bashrc:\n  dir: /bash\n  pat: \\.sh$\n")},
+			"bash/aliases.sh": {Data: []byte("---\ndescription: aliases\n---\nalias ll='ls -l'\n")},
+			"bash/path.sh":    {Data: []byte("---\npriority: -1\n---\nPATH=~/bin:$PATH\n")},
+			"bash/prompt.sh":  {Data: []byte("---\ntags: [bash+zsh]\ntemplate: true\ndelims: ['<%', '%>']\n---\nPS1=<% .linux %>{{}}\n")},
+			"bash/mac.sh":     {Data: []byte("---\ntags: [darwin]\n---\nmac\n")},
+			"bash/unix.sh":    {Data: []byte("---\ntags: [-darwin]\n---\nunix\n")},
+			"bash/plain.sh":   {Data: []byte("no front matter\n")},
+		}
+		targets := &MemTargetFS{}
+
+		// WHEN the pipeline runs
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  dotfilesFS,
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     targets,
+		})
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the front matters are stripped, their tags gate the fragments
+		// as tag expressions, their priorities order them and the template
+		// uses its delimiters
+		want := "PATH=~/bin:$PATH\n\nalias ll='ls -l'\n\nno front matter\n\nPS1=linux{{}}\n\nunix\n"
+		if got := string(targets.Files["/home/user/.bashrc"].Content); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
+
+func TestLoadComponents(t *testing.T) {
+	t.Run("tag_syntax", func(t *testing.T) {
+		app := New(Options{Components: []Component{
+			{Path: "a", FS: fstest.MapFS{}},
+			{Path: "b", FS: fstest.MapFS{"component.yml": {Data: []byte("tag_syntax: at\n")}}},
+			{Path: "c", FS: fstest.MapFS{"component.yml": {Data: []byte("tag_syntax: braces\n")}}, TagSyntax: TagSyntaxUnderscore},
+		}})
+		if err := app.LoadComponents(); err != nil {
+			t.Fatal(err)
+		}
+		var got []TagSyntax
+		for _, component := range app.components {
+			got = append(got, component.TagSyntax)
+		}
+		want := []TagSyntax{TagSyntaxUnderscore, TagSyntaxAt, TagSyntaxUnderscore}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		app := New(Options{Components: []Component{
+			{Path: "a", FS: fstest.MapFS{"component.yml": {Data: []byte("tag_syntax: dash\n")}}},
+		}})
+		want := `a/component.yml: invalid tag_syntax "dash" (want underscore, at or braces)`
+		if err := app.LoadComponents(); err == nil || err.Error() != want {
+			t.Errorf("got %v, want %s", err, want)
+		}
+	})
+}
+
+func TestBanners(t *testing.T) {
+	t.Run("header_separator_footer", func(t *testing.T) {
+		// GIVEN a rule with a header, a separator and a footer
+		rules := `/home/user/init.lua:
+  dir: /nvim
+  pat: \.lua$
+  header: "{{.Comment}} generated by polkadot from {{len .Sources}} files, do not edit"
+  separator: |
+    {{.Comment}} --- from {{.Source.Path}} ({{.Tags.linux}}) ---
+  footer: "{{.Comment}} end of {{.Target}}"
+`
+		componentFS := fstest.MapFS{
+			"rules.yml":        {Data: []byte(rules)},
+			"nvim/a.lua":       {Data: []byte("a\n")},
+			"nvim/b_linux.lua": {Data: []byte("b\n\n")},
+		}
+		targets := &MemTargetFS{}
+		app := New(Options{
+			DotfilesDir: "/dotfiles",
+			DotfilesFS:  fstest.MapFS{"entry.yml": {Data: []byte("linux:\n")}},
+			Components:  []Component{{Path: "common", FS: componentFS}},
+			StateDir:    t.TempDir(),
+			Targets:     targets,
+		})
+
+		// WHEN generated
+		if err := app.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Execute(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the banners surround the fragments, as Lua comments
+		want := "-- generated by polkadot from 2 files, do not edit\n" +
+			"-- --- from common/nvim/a.lua (linux) ---\n" +
+			"a\n\n" +
+			"-- --- from common/nvim/b_linux.lua (linux) ---\n" +
+			"b\n" +
+			"-- end of /home/user/init.lua\n"
+		if got := string(targets.Files["/home/user/init.lua"].Content); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+
+	t.Run("comment_syntax", func(t *testing.T) {
+		cases := []struct {
+			target DotTarget
+			want   string
+		}{
+			{DotTarget{Path: "~/.bashrc"}, "#"},
+			{DotTarget{Path: "~/.config/nvim/init.lua"}, "--"},
+			{DotTarget{Path: "~/.vimrc"}, `"`},
+			{DotTarget{Path: "~/.emacs.d/init.el"}, ";;"},
+			{DotTarget{Path: "~/.bashrc", Comment: "//"}, "//"},
+		}
+		for _, c := range cases {
+			if got := c.target.comment(); got != c.want {
+				t.Errorf("%+v: got %q, want %q", c.target, got, c.want)
+			}
+		}
+	})
+}
+
+func TestPrune(t *testing.T) {
+	setup := func(t *testing.T) (App, string, string, string) {
+		dir := t.TempDir()
+		kept := filepath.Join(dir, "kept")
+		orphan := filepath.Join(dir, "orphan")
+		edited := filepath.Join(dir, "edited")
+		os.WriteFile(kept, []byte("kept\n"), 0644)
+		os.WriteFile(orphan, []byte("orphan\n"), 0644)
+		os.WriteFile(edited, []byte("edited by hand\n"), 0644)
+		app := App{
+			stateDirPath: filepath.Join(dir, ".polkadot"),
+			dotEntries:   []DotEntry{{Target: DotTarget{Path: kept}}},
+			manifest: &Manifest{Targets: []ManifestTarget{
+				{Path: kept, Hash: hashContent([]byte("kept\n"))},
+				{Path: orphan, Hash: hashContent([]byte("orphan\n"))},
+				{Path: edited, Hash: hashContent([]byte("edited\n"))},
+			}},
+		}
+		return app, kept, orphan, edited
+	}
+
+	t.Run("removes_orphans", func(t *testing.T) {
+		app, kept, orphan, edited := setup(t)
+		if err := app.Prune(false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+			t.Error("expected orphan to be removed")
+		}
+		if _, err := os.Stat(kept); err != nil {
+			t.Error("expected kept to remain")
+		}
+		if _, err := os.Stat(edited); err != nil {
+			t.Error("expected edited orphan to remain")
+		}
+		m, err := LoadManifest(app.manifestPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.Lookup(orphan); ok {
+			t.Error("expected orphan to be dropped from the manifest")
+		}
+		if _, ok := m.Lookup(edited); !ok {
+			t.Error("expected edited orphan to stay in the manifest")
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		// GIVEN a run which only prunes an orphan
+		app, _, orphan, _ := setup(t)
+		if err := app.saveManifest(); err != nil {
+			t.Fatal(err)
+		}
+		if err := app.Prune(false); err != nil {
+			t.Fatal(err)
+		}
+
+		// WHEN the last run is rolled back
+		run, err := LoadStateBackupRun(app.stateDirPath, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := run.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+
+		// THEN the orphan is back, and so is its manifest record
+		if content, err := os.ReadFile(orphan); err != nil || string(content) != "orphan\n" {
+			t.Errorf("got %q (%v), want %q", content, err, "orphan\n")
+		}
+		m, err := LoadManifest(app.manifestPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m.Lookup(orphan); !ok {
+			t.Error("expected the orphan back in the manifest")
+		}
+	})
+
+	t.Run("dry_run", func(t *testing.T) {
+		app, _, orphan, _ := setup(t)
+		if err := app.Prune(true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(orphan); err != nil {
+			t.Error("expected orphan to remain in dry-run mode")
+		}
+		if _, err := os.Stat(app.manifestPath()); !os.IsNotExist(err) {
+			t.Error("expected manifest not to be written in dry-run mode")
+		}
+	})
+}
+
+func TestConflict(t *testing.T) {
+	setup := func(t *testing.T) (App, string) {
+		dir := t.TempDir()
+		p := filepath.Join(dir, "a.conf")
+		os.WriteFile(p, []byte("new\n"), 0644)
+		out := filepath.Join(dir, "out.conf")
+		os.WriteFile(out, []byte("edited\n"), 0644)
+		app := App{
+			stateDirPath: filepath.Join(dir, ".polkadot"),
+			dotEntries: []DotEntry{{
+				Sources: []DotSource{{Name: "a.conf", Path: p, Tags: []string{}}},
+				Target:  DotTarget{Path: out},
+			}},
+			manifest: &Manifest{Targets: []ManifestTarget{
+				{Path: out, Hash: hashContent([]byte("generated\n"))},
+			}},
+		}
+		return app, out
+	}
+
+	t.Run("refuses_edited", func(t *testing.T) {
+		app, out := setup(t)
+		err := app.Generate()
+		var conflictErr *ConflictError
+		if !errors.As(err, &conflictErr) {
+			t.Fatalf("expected ConflictError, got %v", err)
+		}
+		if !reflect.DeepEqual(conflictErr.Paths, []string{out}) {
+			t.Errorf("got %v, want %v", conflictErr.Paths, []string{out})
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "edited\n" {
+			t.Errorf("expected target to be untouched, got %q", string(content))
+		}
+	})
+
+	t.Run("force", func(t *testing.T) {
+		app, out := setup(t)
+		app.force = true
+		if err := app.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "new\n" {
+			t.Errorf("got %q, want %q", string(content), "new\n")
+		}
+	})
+
+	t.Run("keep_edits", func(t *testing.T) {
+		app, out := setup(t)
+		app.keepEdits = true
+		if err := app.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		if saved, _ := filepath.Glob(out + ".edited-*"); len(saved) != 0 {
+			t.Errorf("expected no copy next to the target, got %v", saved)
+		}
+		saved := filepath.Join(app.stateDirPath, editedDirName, app.backup.ID, out)
+		content, _ := os.ReadFile(saved)
+		if string(content) != "edited\n" {
+			t.Errorf("got %q, want %q", string(content), "edited\n")
+		}
+
+		// and rollback restores the edited target
+		run, err := LoadStateBackupRun(app.stateDirPath, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := run.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		if content, _ := os.ReadFile(out); string(content) != "edited\n" {
+			t.Errorf("got %q, want %q", string(content), "edited\n")
+		}
+	})
+
+	t.Run("unrecorded_target", func(t *testing.T) {
+		app, out := setup(t)
+		app.manifest = &Manifest{}
+		if err := app.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(out)
+		if string(content) != "new\n" {
+			t.Errorf("got %q, want %q", string(content), "new\n")
+		}
+	})
+}
+
+func TestGenerateError(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.conf")
+	bad := filepath.Join(dir, "bad_gtp.conf")
+	os.WriteFile(good, []byte("good\n"), 0644)
+	os.WriteFile(bad, []byte(`{{.broken`), 0644)
+
+	outA := filepath.Join(dir, "a")
+	outB := filepath.Join(dir, "b")
+	app := App{
+		stateDirPath: filepath.Join(dir, ".polkadot"),
+		dotEntries: []DotEntry{
+			{Sources: []DotSource{{Name: "good.conf", Path: good, Tags: []string{}}}, Target: DotTarget{Path: outA}},
+			{Sources: []DotSource{{Name: "bad_gtp.conf", Path: bad, Tags: []string{"gtp"}}}, Target: DotTarget{Path: outB}},
+		},
+		manifest: &Manifest{},
+	}
+	err := app.Generate()
+	var generateErr *GenerateError
+	if !errors.As(err, &generateErr) {
+		t.Fatalf("expected GenerateError, got %v", err)
+	}
+	if !reflect.DeepEqual(generateErr.Committed, []string{outA}) {
+		t.Errorf("got %v, want %v", generateErr.Committed, []string{outA})
+	}
+	m, err := LoadManifest(app.manifestPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Lookup(outA); !ok {
+		t.Error("expected the committed target to be recorded")
+	}
+}
+
+func TestTagSyntax(t *testing.T) {
+	cases := []struct {
+		syntax TagSyntax
+		base   string
+		name   string
+		tags   []string
+		ext    string
+	}{
+		{TagSyntaxUnderscore, "bashrc", "bashrc", []string{}, ""},
+		{TagSyntaxUnderscore, "gitconfig_work_gtp", "gitconfig", []string{"work", "gtp"}, ""},
+		{TagSyntaxUnderscore, "alacritty_linux.yml", "alacritty", []string{"linux"}, ".yml"},
+		{TagSyntaxUnderscore, "init_gtp.tar.gz", "init", []string{"gtp"}, ".tar.gz"},
+		{TagSyntaxUnderscore, ".gitignore", ".gitignore", []string{}, ""},
+		{TagSyntaxUnderscore, ".gitignore_work", ".gitignore", []string{"work"}, ""},
+		{TagSyntaxUnderscore, ".tmux_linux.conf", ".tmux", []string{"linux"}, ".conf"},
+		{TagSyntaxAt, "git_completion@bash.sh", "git_completion", []string{"bash"}, ".sh"},
+		{TagSyntaxAt, "git_completion.sh", "git_completion", []string{}, ".sh"},
+		{TagSyntaxBraces, "git_completion.{bash,gtp}.sh", "git_completion", []string{"bash", "gtp"}, ".sh"},
+		{TagSyntaxBraces, "a.b.{-darwin}.tar.gz", "a.b", []string{"-darwin"}, ".tar.gz"},
+		{TagSyntaxBraces, ".gitconfig.{work}", ".gitconfig", []string{"work"}, ""},
+		{TagSyntaxBraces, "git_completion.sh", "git_completion", []string{}, ".sh"},
+	}
+	for _, c := range cases {
+		name, tags, ext := c.syntax.split(c.base)
+		if name != c.name || !reflect.DeepEqual(tags, c.tags) || ext != c.ext {
+			t.Errorf("%s: split(%q) = %q, %q, %q, want %q, %q, %q", c.syntax, c.base, name, tags, ext, c.name, c.tags, c.ext)
+		}
+	}
+	if got := untaggedPath("themes/dark_linux_gtp.toml", TagSyntaxUnderscore); got != "themes/dark.toml" {
+		t.Errorf("got %q, want %q", got, "themes/dark.toml")
+	}
+	if got := untaggedPath("themes/dark.{linux}.toml", TagSyntaxBraces); got != "themes/dark.toml" {
+		t.Errorf("got %q, want %q", got, "themes/dark.toml")
+	}
+}
+
+func TestTagSatisfied(t *testing.T) {
+	tagMap := map[string]string{"linux": "linux", "os": "linux", "a=b": "c"}
+	cases := []struct {
+		tag  string
+		want bool
+	}{
+		{"linux", true},
+		{"darwin", false},
+		{"-darwin", true},
+		{"-linux", false},
+		{"darwin+linux", true},
+		{"darwin+bsd", false},
+		{"os=linux", true},
+		{"os=darwin", false},
+		{"-os=darwin", true},
+		{"a%3Db", true},
+		{"a%3Db=c", true},
+		{"%zz", false},
+	}
+	for _, c := range cases {
+		if got := tagSatisfied(c.tag, tagMap); got != c.want {
+			t.Errorf("tagSatisfied(%q) = %v, want %v", c.tag, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package polkadot
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Targets
+
+// TargetFS reads and writes the generated targets. Paths are the target paths
+// resolved by TargetPaths.
+type TargetFS interface {
+	Stat(path string) (fs.FileInfo, error)
+	// Lstat is Stat which does not follow a symbolic link at path.
+	Lstat(path string) (fs.FileInfo, error)
+	ReadFile(path string) ([]byte, error)
+	Readlink(path string) (string, error)
+	// WriteFile replaces the file at path with content and mode, creating its
+	// directory if needed. The file must never be left half-written.
+	WriteFile(path string, content []byte, mode fs.FileMode) error
+	// Symlink replaces the file at path with a symbolic link to oldname, in
+	// the same way as WriteFile.
+	Symlink(oldname string, path string) error
+	Chmod(path string, mode fs.FileMode) error
+	Remove(path string) error
+}
+
+// targetFSOrDisk returns targets, or the disk if targets is nil.
+func targetFSOrDisk(targets TargetFS) TargetFS {
+	if targets == nil {
+		return OSTargetFS{}
+	}
+	return targets
+}
+
+// TargetPaths maps the target paths written in rules.yml to the paths of the
+// generated files.
+type TargetPaths struct {
+	// Home is what ~/ expands to, the home directory of the user if empty.
+	Home string
+	// Root, if set, is prepended to every target path, e.g. to stage the
+	// targets for a package or a container image.
+	Root string
+}
+
+// Resolve expands ~/ in path and prepends Root.
+func (p TargetPaths) Resolve(path string) (string, error) {
+	if strings.HasPrefix(path, "~/") {
+		home := p.Home
+		if home == "" {
+			var err error
+			home, err = os.UserHomeDir()
+			if err != nil {
+				return "", fmt.Errorf("expand home: %w", err)
+			}
+		}
+		path = filepath.Join(home, path[2:])
+	}
+	if p.Root == "" {
+		return path, nil
+	}
+	return filepath.Join(p.Root, path[len(filepath.VolumeName(path)):]), nil
+}
+
+// OSTargetFS writes the targets to the disk.
+type OSTargetFS struct{}
+
+func (OSTargetFS) Stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (OSTargetFS) Lstat(path string) (fs.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (OSTargetFS) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (OSTargetFS) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+// WriteFile writes content atomically, see writeFileAtomic.
+func (OSTargetFS) WriteFile(path string, content []byte, mode fs.FileMode) error {
+	// mkdir -p
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	return writeFileAtomic(path, content, mode)
+}
+
+// Symlink creates the link under a temporary name and renames it over path.
+func (OSTargetFS) Symlink(oldname string, path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	tmpPath := filepath.Join(dir, fmt.Sprintf(".%s.polkadot-%d", filepath.Base(path), time.Now().UnixNano()))
+	if err := os.Symlink(oldname, tmpPath); err != nil {
+		return fmt.Errorf("symlink %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("rename %s: %w", tmpPath, err)
+	}
+	return nil
+}
+
+func (OSTargetFS) Chmod(path string, mode fs.FileMode) error {
+	return os.Chmod(path, mode)
+}
+
+func (OSTargetFS) Remove(path string) error {
+	return os.Remove(path)
+}
+
+// writeFileAtomic writes content to a temporary file in the same directory
+// and renames it over path, so that path is never left half-written.
+func writeFileAtomic(path string, content []byte, mode os.FileMode) (err error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".polkadot-*")
+	if err != nil {
+		return fmt.Errorf("create temporary file for %s: %w", path, err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	if _, err := tmpFile.Write(content); err != nil {
+		return fmt.Errorf("write %s: %w", tmpPath, err)
+	}
+	if err := tmpFile.Chmod(mode); err != nil {
+		return fmt.Errorf("chmod %s: %w", tmpPath, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", tmpPath, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("rename %s: %w", tmpPath, err)
+	}
+	return nil
+}
+
+// MemTargetFS keeps the targets in memory, e.g. to render them without
+// touching the disk. The zero value is empty and ready to use. Symbolic links
+// are never followed.
+type MemTargetFS struct {
+	Files map[string]*MemTarget
+}
+
+// MemTarget is a target kept by MemTargetFS: a file, or a symbolic link to
+// Link.
+type MemTarget struct {
+	Content []byte
+	Mode    fs.FileMode
+	ModTime time.Time
+	Link    string
+}
+
+// Paths returns the paths of the targets, sorted.
+func (m *MemTargetFS) Paths() []string {
+	paths := make([]string, 0, len(m.Files))
+	for path := range m.Files {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func (m *MemTargetFS) lookup(op string, path string) (*MemTarget, error) {
+	file, ok := m.Files[path]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+	}
+	return file, nil
+}
+
+func (m *MemTargetFS) Stat(path string) (fs.FileInfo, error) {
+	file, err := m.lookup("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	return memTargetInfo{name: filepath.Base(path), file: file}, nil
+}
+
+func (m *MemTargetFS) Lstat(path string) (fs.FileInfo, error) {
+	return m.Stat(path)
+}
+
+func (m *MemTargetFS) ReadFile(path string) ([]byte, error) {
+	file, err := m.lookup("read", path)
+	if err != nil {
+		return nil, err
+	}
+	if file.Link != "" {
+		return nil, &fs.PathError{Op: "read", Path: path, Err: fs.ErrInvalid}
+	}
+	return slices.Clone(file.Content), nil
+}
+
+func (m *MemTargetFS) Readlink(path string) (string, error) {
+	file, err := m.lookup("readlink", path)
+	if err != nil {
+		return "", err
+	}
+	if file.Link == "" {
+		return "", &fs.PathError{Op: "readlink", Path: path, Err: fs.ErrInvalid}
+	}
+	return file.Link, nil
+}
+
+func (m *MemTargetFS) WriteFile(path string, content []byte, mode fs.FileMode) error {
+	if m.Files == nil {
+		m.Files = make(map[string]*MemTarget)
+	}
+	m.Files[path] = &MemTarget{Content: slices.Clone(content), Mode: mode.Perm(), ModTime: time.Now()}
+	return nil
+}
+
+func (m *MemTargetFS) Symlink(oldname string, path string) error {
+	if m.Files == nil {
+		m.Files = make(map[string]*MemTarget)
+	}
+	m.Files[path] = &MemTarget{Mode: fs.ModeSymlink | 0777, ModTime: time.Now(), Link: oldname}
+	return nil
+}
+
+func (m *MemTargetFS) Chmod(path string, mode fs.FileMode) error {
+	file, err := m.lookup("chmod", path)
+	if err != nil {
+		return err
+	}
+	if file.Link == "" {
+		file.Mode = mode.Perm()
+	}
+	return nil
+}
+
+func (m *MemTargetFS) Remove(path string) error {
+	if _, err := m.lookup("remove", path); err != nil {
+		return err
+	}
+	delete(m.Files, path)
+	return nil
+}
+
+type memTargetInfo struct {
+	name string
+	file *MemTarget
+}
+
+func (i memTargetInfo) Name() string       { return i.name }
+func (i memTargetInfo) Size() int64        { return int64(len(i.file.Content)) }
+func (i memTargetInfo) Mode() fs.FileMode  { return i.file.Mode }
+func (i memTargetInfo) ModTime() time.Time { return i.file.ModTime }
+func (i memTargetInfo) IsDir() bool        { return false }
+func (i memTargetInfo) Sys() any           { return nil }
@@ -0,0 +1,81 @@
+package polkadot
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTargetPaths(t *testing.T) {
+	cases := []struct {
+		paths TargetPaths
+		path  string
+		want  string
+	}{
+		{TargetPaths{Home: "/home/user"}, "~/.bashrc", "/home/user/.bashrc"},
+		{TargetPaths{Home: "/home/user"}, "/etc/hosts", "/etc/hosts"},
+		{TargetPaths{Home: "/home/user", Root: "out"}, "~/.bashrc", "out/home/user/.bashrc"},
+		{TargetPaths{Root: "/stage"}, "/etc/hosts", "/stage/etc/hosts"},
+	}
+	for _, c := range cases {
+		got, err := c.paths.Resolve(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%+v.Resolve(%q) = %q, want %q", c.paths, c.path, got, c.want)
+		}
+	}
+}
+
+func TestTargetFS(t *testing.T) {
+	t.Run("os/creates_directory", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "a", "b", "out.conf")
+		if err := (OSTargetFS{}).WriteFile(p, []byte("aaa\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("got mode %04o, want 0600", info.Mode().Perm())
+		}
+	})
+
+	t.Run("mem/round_trip", func(t *testing.T) {
+		m := &MemTargetFS{}
+		if err := m.WriteFile("/home/user/.bashrc", []byte("aaa\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Chmod("/home/user/.bashrc", 0600); err != nil {
+			t.Fatal(err)
+		}
+		info, err := m.Stat("/home/user/.bashrc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name() != ".bashrc" || info.Size() != 4 || info.Mode() != 0600 {
+			t.Errorf("got %s (%d bytes, mode %04o)", info.Name(), info.Size(), info.Mode())
+		}
+		content, err := m.ReadFile("/home/user/.bashrc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "aaa\n" {
+			t.Errorf("got %q, want %q", content, "aaa\n")
+		}
+	})
+
+	t.Run("mem/not_exist", func(t *testing.T) {
+		m := &MemTargetFS{}
+		if _, err := m.Stat("/missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat: got %v, want fs.ErrNotExist", err)
+		}
+		if err := m.Remove("/missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Remove: got %v, want fs.ErrNotExist", err)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package polkadot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Templates
+
+// partialsDirName is the directory of a component holding the partials.
+const partialsDirName = "partials"
+
+// templateFuncs returns the functions available to gtp fragments and rule
+// banners. hasTag looks tags up in tagMap. The arguments follow the order of
+// the text/template builtins, the value last, so that they can be piped.
+func templateFuncs(tagMap map[string]string) template.FuncMap {
+	return template.FuncMap{
+		// strings
+		"lower":      strings.ToLower,
+		"upper":      strings.ToUpper,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       func(sep string, elems []string) string { return strings.Join(elems, sep) },
+		"repeat":     func(count int, s string) string { return strings.Repeat(s, count) },
+		"quote":      strconv.Quote,
+		"indent":     indent,
+		// values
+		"hasTag": func(tag string) bool {
+			_, ok := tagMap[tag]
+			return ok
+		},
+		"default": func(def any, value any) any {
+			if value == nil || reflect.ValueOf(value).IsZero() {
+				return def
+			}
+			return value
+		},
+		"env":      os.Getenv,
+		"joinPath": filepath.Join,
+		"toYaml": func(value any) (string, error) {
+			buf, err := yaml.Marshal(value)
+			return strings.TrimSuffix(string(buf), "\n"), err
+		},
+		"toJson": func(value any) (string, error) {
+			buf, err := json.Marshal(value)
+			return string(buf), err
+		},
+	}
+}
+
+// indent prefixes every non-empty line of s with n spaces.
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadPartials parses the files under the partials directory of every
+// component dir as templates named by their path below it, e.g.
+// {{template "git/user.tmpl" .}}. A partial of a later dir replaces the one
+// of the same name from an earlier dir.
+func (a *App) LoadPartials() (*template.Template, error) {
+	partials := template.New(partialsDirName).Funcs(templateFuncs(nil)).Option("missingkey=zero")
+	for _, component := range a.components {
+		err := fs.WalkDir(component.FS, partialsDirName, func(fsPath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if fsPath == partialsDirName && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			diskPath := filepath.Join(component.Path, filepath.FromSlash(fsPath))
+			content, err := fs.ReadFile(component.FS, fsPath)
+			if err != nil {
+				return fmt.Errorf("read %s: %w", diskPath, err)
+			}
+			name := strings.TrimPrefix(fsPath, partialsDirName+"/")
+			if _, err := partials.New(name).Parse(string(content)); err != nil {
+				return fmt.Errorf("parse partial %s: %w", diskPath, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return partials, nil
+}
+
+// newTemplate returns an empty template named name which can call the
+// functions and, if set, the partials.
+func newTemplate(name string, partials *template.Template, tagMap map[string]string) (*template.Template, error) {
+	if partials == nil {
+		return template.New(name).Funcs(templateFuncs(tagMap)), nil
+	}
+	clone, err := partials.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return clone.New(name).Funcs(templateFuncs(tagMap)), nil
+}
+
+// MissingTagError is returned by a strict gtp fragment referring to a tag
+// which is not in the tag map.
+type MissingTagError struct {
+	// Path is the path of the fragment, or of the partial under partials/.
+	Path string
+	Line int
+	Tag  string
+}
+
+func (e *MissingTagError) Error() string {
+	return fmt.Sprintf("%s:%d: missing tag %q", e.Path, e.Line, e.Tag)
+}
+
+// missingKeyMessage matches the message of a template.ExecError for a
+// missing map key: its template, line and key.
+var missingKeyMessage = regexp.MustCompile(`^template: (.+):(\d+):\d+: executing .*: map has no entry for key "(.*)"$`)
+
+// asMissingTagError returns err as a MissingTagError if it is one, nil
+// otherwise. name is the template of the fragment at path.
+func asMissingTagError(err error, name string, path string) *MissingTagError {
+	var execErr template.ExecError
+	if !errors.As(err, &execErr) {
+		return nil
+	}
+	m := missingKeyMessage.FindStringSubmatch(execErr.Error())
+	if m == nil {
+		return nil
+	}
+	line, _ := strconv.Atoi(m[2])
+	if m[1] != name {
+		path = partialsDirName + "/" + m[1]
+	}
+	return &MissingTagError{Path: path, Line: line, Tag: m[3]}
+}
+
+// renderRulePath renders a target path or a directory of rules.yml, which
+// may be a template of the tag map, e.g. {{if hasTag "darwin"}}~/Library{{end}}.
+// An empty result disables the path. A missing tag is an error, since it
+// would leave a path such as /alacritty.yml; optional parts use hasTag or
+// index.
+func renderRulePath(text string, tagMap map[string]string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tpl, err := template.New(text).Funcs(templateFuncs(tagMap)).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := tpl.Execute(&buf, tagMap); err != nil {
+		if missing := asMissingTagError(err, text, text); missing != nil {
+			return "", fmt.Errorf("missing tag %q in %q (use hasTag or index for an optional tag)", missing.Tag, text)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
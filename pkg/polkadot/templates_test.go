@@ -0,0 +1,84 @@
+package polkadot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTemplateFuncs(t *testing.T) {
+	t.Setenv("POLKADOT_TEST_ENV", "from env")
+	tagMap := map[string]string{"linux": "linux", "editor": "nvim"}
+	data := map[string]any{
+		"tags":  tagMap,
+		"empty": "",
+		"list":  []string{"a", "b"},
+		"block": "x: 1\ny: 2",
+	}
+	cases := []struct {
+		text string
+		want string
+	}{
+		{`{{"Hello" | upper}} {{"Hello" | lower}} {{"  x  " | trim}}`, "HELLO hello x"},
+		{`{{"a.b.c" | replace "." "/"}} {{"v1.2" | trimPrefix "v"}}`, "a/b/c 1.2"},
+		{`{{if "nvim" | hasPrefix "nv"}}yes{{end}} {{"a,b" | split "," | join ";"}}`, "yes a;b"},
+		{`{{if hasTag "linux"}}linux{{end}}{{if hasTag "darwin"}}darwin{{end}}`, "linux"},
+		{`{{.empty | default "none"}} {{.tags.editor | default "vi"}}`, "none nvim"},
+		{`{{env "POLKADOT_TEST_ENV"}} {{quote "a\"b"}}`, `from env "a\"b"`},
+		{`{{joinPath "a" "b" "c.conf"}}`, "a/b/c.conf"},
+		{`{{.block | indent 2}}`, "  x: 1\n  y: 2"},
+		{`{{toJson .list}}`, `["a","b"]`},
+		{`{{toYaml .list}}`, "- a\n- b"},
+	}
+	for _, c := range cases {
+		tpl, err := newTemplate("test", nil, tagMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tpl.Parse(c.text); err != nil {
+			t.Fatalf("parse %s: %v", c.text, err)
+		}
+		var buf bytes.Buffer
+		if err := tpl.Execute(&buf, data); err != nil {
+			t.Fatalf("execute %s: %v", c.text, err)
+		}
+		if buf.String() != c.want {
+			t.Errorf("%s: got %q, want %q", c.text, buf.String(), c.want)
+		}
+	}
+}
+
+func TestPartials(t *testing.T) {
+	// GIVEN partials in two components, the second overriding one of them
+	base := fstest.MapFS{
+		"partials/greeting.tmpl":   {Data: []byte("hello {{.name}}")},
+		"partials/git/user.tmpl":   {Data: []byte("[user]\n\tname = base")},
+		"fragments/config_gtp.txt": {Data: []byte(`{{template "greeting.tmpl" .}} / {{template "git/user.tmpl" .}}`)},
+	}
+	host := fstest.MapFS{
+		"partials/git/user.tmpl": {Data: []byte("[user]\n\tname = {{.name | upper}}")},
+	}
+	app := New(Options{Components: []Component{{Path: "base", FS: base}, {Path: "host", FS: host}}})
+	partials, err := app.LoadPartials()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// WHEN a gtp fragment calls them
+	g := Generator{Partials: partials}
+	entry := DotEntry{
+		Sources: []DotSource{{Name: "config_gtp.txt", Path: "base/fragments/config_gtp.txt", Tags: []string{"gtp"}, FS: base, FSPath: "fragments/config_gtp.txt"}},
+		Target:  DotTarget{Path: "/tmp/config"},
+	}
+	content, err := g.Render(entry, map[string]string{"name": "taskie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// THEN the later partial wins
+	want := "hello taskie / [user]\n\tname = TASKIE"
+	if got := strings.TrimSuffix(string(content), "\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}